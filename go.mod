@@ -11,6 +11,7 @@ require (
 	github.com/vmware/govmomi v0.30.4
 	golang.org/x/lint v0.0.0-20210508222113-6edffad5e616
 	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/api v0.26.3
 	k8s.io/component-base v0.26.3
 	k8s.io/klog/v2 v2.100.1
@@ -65,7 +66,6 @@ require (
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	k8s.io/apimachinery v0.26.3 // indirect
 	k8s.io/apiserver v0.26.3 // indirect
 	k8s.io/client-go v0.26.3 // indirect
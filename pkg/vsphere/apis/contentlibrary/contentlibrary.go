@@ -0,0 +1,65 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package contentlibrary
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TemplatePrefix is the prefix of a templateVM referencing a content library item instead of an inventory path.
+// The item is specified either as `library:<library name>/<item name>` or as `library:<item id>`.
+const TemplatePrefix = "library:"
+
+// Item references a content library item either by library and item name or by item ID
+type Item struct {
+	Library string
+	Name    string
+	ID      string
+}
+
+// String returns the item reference in templateVM notation
+func (i *Item) String() string {
+	if i.ID != "" {
+		return TemplatePrefix + i.ID
+	}
+	return TemplatePrefix + i.Library + "/" + i.Name
+}
+
+// IsLibraryTemplate checks if the templateVM references a content library item
+func IsLibraryTemplate(templateVM string) bool {
+	return strings.HasPrefix(templateVM, TemplatePrefix)
+}
+
+// ParseTemplate parses a templateVM referencing a content library item.
+// Returns nil if the templateVM is an inventory path.
+func ParseTemplate(templateVM string) (*Item, error) {
+	if !IsLibraryTemplate(templateVM) {
+		return nil, nil
+	}
+	ref := strings.TrimPrefix(templateVM, TemplatePrefix)
+	if !strings.Contains(ref, "/") {
+		if ref == "" {
+			return nil, fmt.Errorf("missing library item in %q", templateVM)
+		}
+		return &Item{ID: ref}, nil
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid library item %q, expected %s<library name>/<item name> or %s<item id>", templateVM, TemplatePrefix, TemplatePrefix)
+	}
+	return &Item{Library: parts[0], Name: parts[1]}, nil
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package contentlibrary
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestParseTemplate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	item, err := ParseTemplate("/dc/vm/templates/ubuntu")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(item).To(gomega.BeNil())
+
+	item, err = ParseTemplate("library:images/ubuntu-22.04")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(*item).To(gomega.Equal(Item{Library: "images", Name: "ubuntu-22.04"}))
+	g.Expect(item.String()).To(gomega.Equal("library:images/ubuntu-22.04"))
+
+	item, err = ParseTemplate("library:0d1a1b0e-2bba-4d3b-9d7f-3a3c1e1f1a2b")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(*item).To(gomega.Equal(Item{ID: "0d1a1b0e-2bba-4d3b-9d7f-3a3c1e1f1a2b"}))
+
+	_, err = ParseTemplate("library:")
+	g.Expect(err).NotTo(gomega.BeNil())
+	_, err = ParseTemplate("library:images/")
+	g.Expect(err).NotTo(gomega.BeNil())
+}
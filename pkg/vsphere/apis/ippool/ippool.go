@@ -0,0 +1,151 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package ippool
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+	"strings"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// Range is an inclusive range of IP addresses
+type Range struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// Contains checks if the address is part of the range
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+// Size returns the number of addresses of the range
+func (r Range) Size() *big.Int {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(r.Last.AsSlice()), new(big.Int).SetBytes(r.First.AsSlice()))
+	return size.Add(size, big.NewInt(1))
+}
+
+// ParseRange parses a single IP address, a range of the form `first-last` or a CIDR.
+// For IPv4 CIDRs the network and broadcast addresses are omitted.
+func ParseRange(s string) (Range, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		prefix = prefix.Masked()
+		first := prefix.Addr()
+		last := lastAddr(prefix)
+		if first.Is4() && prefix.Bits() < 31 {
+			first = first.Next()
+			last = last.Prev()
+		}
+		return Range{First: first, Last: last}, nil
+	}
+	if parts := strings.Split(s, "-"); len(parts) == 2 {
+		first, err1 := netip.ParseAddr(strings.TrimSpace(parts[0]))
+		last, err2 := netip.ParseAddr(strings.TrimSpace(parts[1]))
+		if err1 != nil || err2 != nil || first.BitLen() != last.BitLen() || last.Less(first) {
+			return Range{}, fmt.Errorf("invalid IP range %q", s)
+		}
+		return Range{First: first, Last: last}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return Range{First: addr, Last: addr}, nil
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for i := range bytes {
+		bits := prefix.Bits() - i*8
+		switch {
+		case bits <= 0:
+			bytes[i] = 0xff
+		case bits < 8:
+			bytes[i] |= 0xff >> bits
+		}
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// Pool is a parsed IP pool
+type Pool struct {
+	ranges       []Range
+	excludes     []Range
+	prefixLength int
+}
+
+// NewPool parses the given pool spec
+func NewPool(spec *api.VSphereIPPool) (*Pool, error) {
+	pool := &Pool{prefixLength: spec.PrefixLength}
+	for _, s := range spec.Ranges {
+		r, err := ParseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		pool.ranges = append(pool.ranges, r)
+	}
+	for _, s := range spec.Excludes {
+		r, err := ParseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		pool.excludes = append(pool.excludes, r)
+	}
+	return pool, nil
+}
+
+// Allocate returns the first address of the pool which is neither excluded nor used
+// in CIDR notation using the prefix length of the pool.
+// Excluded ranges are skipped as a whole, so the number of steps only depends on the used addresses.
+func (p *Pool) Allocate(used map[netip.Addr]bool) (string, error) {
+	for _, r := range p.ranges {
+		for addr := r.First; addr.IsValid() && r.Contains(addr); addr = addr.Next() {
+			if exclude, ok := p.exclude(addr); ok {
+				addr = exclude.Last
+				continue
+			}
+			if used[addr] {
+				continue
+			}
+			prefix := netip.PrefixFrom(addr, p.prefixLength)
+			if !prefix.IsValid() {
+				return "", fmt.Errorf("invalid prefix length %d for address %s", p.prefixLength, addr)
+			}
+			return prefix.String(), nil
+		}
+	}
+	return "", fmt.Errorf("IP pool exhausted")
+}
+
+// exclude returns the exclude range containing the address
+func (p *Pool) exclude(addr netip.Addr) (Range, bool) {
+	for _, r := range p.excludes {
+		if r.Contains(addr) {
+			return r, true
+		}
+	}
+	return Range{}, false
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package ippool
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/onsi/gomega"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestParseRange(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	r, err := ParseRange("10.0.0.0/24")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(r.First.String()).To(gomega.Equal("10.0.0.1"))
+	g.Expect(r.Last.String()).To(gomega.Equal("10.0.0.254"))
+
+	r, err = ParseRange("10.0.0.10-10.0.0.20")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(r.First.String()).To(gomega.Equal("10.0.0.10"))
+	g.Expect(r.Last.String()).To(gomega.Equal("10.0.0.20"))
+
+	r, err = ParseRange("fd00::/120")
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(r.First.String()).To(gomega.Equal("fd00::"))
+	g.Expect(r.Last.String()).To(gomega.Equal("fd00::ff"))
+
+	g.Expect(r.Size().Int64()).To(gomega.Equal(int64(256)))
+
+	_, err = ParseRange("10.0.0.20-10.0.0.10")
+	g.Expect(err).NotTo(gomega.BeNil())
+	_, err = ParseRange("10.0.0.300")
+	g.Expect(err).NotTo(gomega.BeNil())
+}
+
+func TestAllocate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	pool, err := NewPool(&api.VSphereIPPool{
+		Ranges:       []string{"10.0.0.0/29"},
+		Excludes:     []string{"10.0.0.1", "10.0.0.3-10.0.0.4"},
+		PrefixLength: 24,
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	used := map[netip.Addr]bool{netip.MustParseAddr("10.0.0.2"): true}
+	address, err := pool.Allocate(used)
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(address).To(gomega.Equal("10.0.0.5/24"))
+
+	used[netip.MustParseAddr("10.0.0.5")] = true
+	used[netip.MustParseAddr("10.0.0.6")] = true
+	_, err = pool.Allocate(used)
+	g.Expect(err).To(gomega.MatchError("IP pool exhausted"))
+}
+
+func TestAllocateLargeExclude(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	pool, err := NewPool(&api.VSphereIPPool{
+		Ranges:       []string{"fd00::/64"},
+		Excludes:     []string{"fd00::/65"},
+		PrefixLength: 64,
+	})
+	g.Expect(err).To(gomega.BeNil())
+
+	address, err := pool.Allocate(map[netip.Addr]bool{netip.MustParseAddr("fd00::8000:0:0:0"): true})
+	g.Expect(err).To(gomega.BeNil())
+	g.Expect(address).To(gomega.Equal("fd00::8000:0:0:1/64"))
+}
+
+func TestAllocateInvalidPrefixLength(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	pool, err := NewPool(&api.VSphereIPPool{Ranges: []string{"10.0.0.0/29"}, PrefixLength: 64})
+	g.Expect(err).To(gomega.BeNil())
+
+	_, err = pool.Allocate(map[netip.Addr]bool{})
+	g.Expect(err).To(gomega.MatchError("invalid prefix length 64 for address 10.0.0.1"))
+}
@@ -23,6 +23,13 @@ const (
 	TagMCMClusterName = "mcm.gardener.cloud/cluster"
 	// TagMCMRole is the tag key for tagging a VM with its role (e.g 'node')
 	TagMCMRole = "mcm.gardener.cloud/role"
+
+	// TagModeCustomAttributes places the tags as custom attributes on the VM
+	TagModeCustomAttributes = "customAttributes"
+	// TagModeVSphereTags places the tags as vSphere tags on the VM
+	TagModeVSphereTags = "vsphereTags"
+	// TagModeBoth places the tags both as custom attributes and as vSphere tags on the VM
+	TagModeBoth = "both"
 )
 
 // VsphereProviderSpec contains the fields of
@@ -34,12 +41,16 @@ type VsphereProviderSpec struct {
 	// Datacenter is the vSphere data center
 	Datacenter string `json:"datacenter"`
 
-	// DatastoreCluster is the data store cluster to use (either DatastoreCluster or Datastore must be specified)
+	// DatastoreCluster is the data store cluster to use (either DatastoreCluster, Datastore or StoragePolicy must be specified)
 	// +optional
 	DatastoreCluster string `json:"datastoreCluster,omitempty"`
-	// Datastore is the data store to use (either DatastoreCluster or Datastore must be specified)
+	// Datastore is the data store to use (either DatastoreCluster, Datastore or StoragePolicy must be specified)
 	// +optional
 	Datastore string `json:"datastore,omitempty"`
+	// StoragePolicy is the name of the VM storage policy applied to the VM home and its disks.
+	// If neither Datastore nor DatastoreCluster is specified, a data store compatible with the policy is chosen.
+	// +optional
+	StoragePolicy string `json:"storagePolicy,omitempty"`
 
 	// ComputeCluster is the compute cluster to use for placement (either ComputeCluster, ResourcePool, or HostSystem must be specified)
 	// +optional
@@ -50,6 +61,12 @@ type VsphereProviderSpec struct {
 	// HostSystem is the host system to use for placement (either ComputeCluster, ResourcePool, or HostSystem must be specified)
 	// +optional
 	HostSystem string `json:"hostSystem,omitempty"`
+	// AntiAffinity spreads the VMs of a group over the hosts of the compute cluster by a DRS anti-affinity rule
+	// +optional
+	AntiAffinity *VSphereAntiAffinity `json:"antiAffinity,omitempty"`
+	// HostGroupAffinity restricts the VMs to the hosts of a DRS host group of the compute cluster
+	// +optional
+	HostGroupAffinity *VSphereHostGroupAffinity `json:"hostGroupAffinity,omitempty"`
 
 	// Folder is the folder to place VMs into
 	// +optional
@@ -61,20 +78,82 @@ type VsphereProviderSpec struct {
 	// MemoryReservationLockedToMax is flag to reserve all guest OS memory (no swapping in ESXi host)
 	// +optional
 	MemoryReservationLockedToMax *bool `json:"memoryReservationLockedToMax,omitempty"`
+	// CPUAllocation is the CPU reservation, limit and shares of the VM (in MHz)
+	// +optional
+	CPUAllocation *VSphereResourceAllocation `json:"cpuAllocation,omitempty"`
+	// MemoryAllocation is the memory reservation, limit and shares of the VM (in MB)
+	// +optional
+	MemoryAllocation *VSphereResourceAllocation `json:"memoryAllocation,omitempty"`
+	// CoresPerSocket is the number of cores per virtual CPU socket, NumCpus must be a multiple of it
+	// +optional
+	CoresPerSocket int `json:"coresPerSocket,omitempty"`
+	// CPUHotAddEnabled is a flag to allow adding CPUs while the VM is running
+	// +optional
+	CPUHotAddEnabled *bool `json:"cpuHotAddEnabled,omitempty"`
+	// MemoryHotAddEnabled is a flag to allow adding memory while the VM is running
+	// +optional
+	MemoryHotAddEnabled *bool `json:"memoryHotAddEnabled,omitempty"`
+	// NUMA specifies the virtual NUMA topology of the VM
+	// +optional
+	NUMA *VSphereNUMA `json:"numa,omitempty"`
+	// LatencySensitivity is the latency sensitivity level of the VM: low, normal or high.
+	// The level high requires a full memory reservation.
+	// +optional
+	LatencySensitivity string `json:"latencySensitivity,omitempty"`
+	// Firmware is the firmware of the VM: bios or efi (defaults to the firmware of the template)
+	// +optional
+	Firmware string `json:"firmware,omitempty"`
+	// SecureBoot is a flag to enable UEFI Secure Boot, requires firmware efi
+	// +optional
+	SecureBoot *bool `json:"secureBoot,omitempty"`
+	// NestedHV is a flag to expose hardware assisted virtualization to the guest OS
+	// +optional
+	NestedHV *bool `json:"nestedHV,omitempty"`
+	// VBS is a flag to enable virtualization-based security, requires firmware efi and Secure Boot.
+	// Nested hardware virtualization and IOMMU are enabled implicitly.
+	// +optional
+	VBS *bool `json:"vbs,omitempty"`
+	// HardwareVersion is the virtual hardware version the VM is upgraded to: `vmx-NN`, `latest` for the highest
+	// version supported by the host or `keep` to keep the version of the template (defaults to vmx-15).
+	// VMs with a higher version are never downgraded.
+	// +optional
+	HardwareVersion string `json:"hardwareVersion,omitempty"`
 	// SystemDisk specifies the system disk
 	// +optional
 	SystemDisk *VSphereSystemDisk `json:"systemDisk,omitempty"`
+	// DataDisks are additional disks created with the VM and destroyed with it
+	// +optional
+	DataDisks []VSphereDataDisk `json:"dataDisks,omitempty"`
 	// ExtraConfig allows to specify additional VM options.
 	// e.g. sched.swap.vmxSwapEnabled=false to disable the VMX process swap file
+	// The values may contain templates like {{ .MachineName }}, see VApp.
+	// Keys with the prefix guestinfo.mcm. are reserved for the machine identity.
 	// +optional
 	ExtraConfig map[string]string `json:"extraConfig,omitempty"`
-	// Network is the vSphere network to use
+	// ExtraConfigFrom are additional VM options with values taken from the secret, e.g. for credentials
+	// +optional
+	ExtraConfigFrom map[string]VSphereValueSource `json:"extraConfigFrom,omitempty"`
+	// Network is the vSphere network to use (either Network or Networks must be specified)
+	// +optional
 	Network string `json:"network"`
 	// SwitchUUID is VDS UUID (only needed if there are multiple virtual distributed switches the network is assigned to)
 	// +optional
 	SwitchUUID string `json:"switchUuid"`
-	// TemplateVM is the VM template to clone
+	// Networks is the list of network interfaces of the VM (either Network or Networks must be specified).
+	// The network cards of the template are edited, added or removed to match this list in order.
+	// +optional
+	Networks []VSphereNetworkInterface `json:"networks,omitempty"`
+	// TemplateVM is the VM template to clone. Alternatively, a content library item of type OVF or VM template
+	// can be deployed by specifying `library:<library name>/<item name>` or `library:<item id>`.
 	TemplateVM string `json:"templateVM"`
+	// LinkedClone is a flag to create the VM as linked clone from a snapshot of the template
+	// instead of a full clone. The template must have a snapshot.
+	// +optional
+	LinkedClone bool `json:"linkedClone,omitempty"`
+	// TemplateSnapshot is the name or path (e.g. base/v1) of the template snapshot to create linked clones from
+	// (defaults to the current snapshot)
+	// +optional
+	TemplateSnapshot string `json:"templateSnapshot,omitempty"`
 	// GuestID is an optional value to overwrite the VM guest id of the templae
 	// +optional
 	GuestID string `json:"guestId,omitempty"`
@@ -93,9 +172,179 @@ type VsphereProviderSpec struct {
 	// SSHKeys is an optional array of ssh public keys to deploy to VM (may already be included in UserData)
 	// +optional
 	SSHKeys []string `json:"sshKeys,omitempty"`
+	// Bootstrap configures how the user data is provided to the VM
+	// +optional
+	Bootstrap *VSphereBootstrap `json:"bootstrap,omitempty"`
 	// Tags to be placed on the VM
 	// +optional
 	Tags map[string]string `json:"tags,omitempty"`
+	// TagMode defines how the tags are placed on the VM: as custom attributes (`customAttributes`, default),
+	// as vSphere tags (`vsphereTags`) or both (`both`). For vSphere tags, the tag key is used as tag category
+	// and the value as tag name. Missing categories and tags are created.
+	// +optional
+	TagMode string `json:"tagMode,omitempty"`
+}
+
+// VSphereAntiAffinity specifies the DRS anti-affinity rule for a group of machines.
+// The rule is created as soon as the group has two VMs and deleted if less than two VMs are left.
+type VSphereAntiAffinity struct {
+	// GroupKey is the key of the tag whose key and value identify the group (defaults to the role of the machine)
+	// +optional
+	GroupKey string `json:"groupKey,omitempty"`
+	// Mandatory makes the rule a hard constraint (must not run on same host) instead of a soft one (should not run on same host)
+	// +optional
+	Mandatory bool `json:"mandatory,omitempty"`
+}
+
+// VSphereHostGroupAffinity specifies the DRS VM/Host rule to run the VMs on the hosts of a host group.
+// The VMs are added to the VM group, which is created together with the rule if missing.
+// The rule and the VM group are deleted together with the last VM.
+type VSphereHostGroupAffinity struct {
+	// HostGroup is the name of an existing DRS host group of the compute cluster
+	HostGroup string `json:"hostGroup"`
+	// VMGroup is the name of the DRS VM group
+	VMGroup string `json:"vmGroup"`
+	// RuleType is the type of the VM/Host rule: `must` or `should` (default) run on hosts in group
+	// +optional
+	RuleType string `json:"ruleType,omitempty"`
+}
+
+const (
+	// HostGroupRuleTypeMust is the rule type for VMs which must run on the hosts of the host group
+	HostGroupRuleTypeMust = "must"
+	// HostGroupRuleTypeShould is the rule type for VMs which should run on the hosts of the host group
+	HostGroupRuleTypeShould = "should"
+)
+
+// VSphereResourceAllocation specifies the allocation of a resource (CPU in MHz, memory in MB)
+type VSphereResourceAllocation struct {
+	// Reservation is the guaranteed amount of the resource
+	// +optional
+	Reservation *int64 `json:"reservation,omitempty"`
+	// Limit is the upper limit of the resource, -1 for unlimited
+	// +optional
+	Limit *int64 `json:"limit,omitempty"`
+	// Shares is the shares level: low, normal, high or custom
+	// +optional
+	Shares string `json:"shares,omitempty"`
+	// CustomShares is the number of shares for the shares level custom
+	// +optional
+	CustomShares int32 `json:"customShares,omitempty"`
+}
+
+const (
+	// SharesLevelLow is the shares level low
+	SharesLevelLow = "low"
+	// SharesLevelNormal is the shares level normal
+	SharesLevelNormal = "normal"
+	// SharesLevelHigh is the shares level high
+	SharesLevelHigh = "high"
+	// SharesLevelCustom is the shares level for a custom number of shares
+	SharesLevelCustom = "custom"
+)
+
+// VSphereNUMA specifies the virtual NUMA settings of a VM, which are applied as extra config
+type VSphereNUMA struct {
+	// MaxVCPUsPerNode is the maximum number of virtual CPUs per virtual NUMA node (numa.vcpu.maxPerVirtualNode)
+	// +optional
+	MaxVCPUsPerNode int `json:"maxVcpusPerNode,omitempty"`
+	// MinVCPUs is the minimum number of virtual CPUs to expose virtual NUMA (numa.vcpu.min)
+	// +optional
+	MinVCPUs int `json:"minVcpus,omitempty"`
+	// FollowCoresPerSocket is a flag to size the virtual NUMA nodes by the cores per socket (numa.vcpu.followcorespersocket)
+	// +optional
+	FollowCoresPerSocket *bool `json:"followCoresPerSocket,omitempty"`
+}
+
+const (
+	// HardwareVersionLatest upgrades to the highest hardware version supported by the host
+	HardwareVersionLatest = "latest"
+	// HardwareVersionKeep keeps the hardware version of the template
+	HardwareVersionKeep = "keep"
+
+	// FirmwareBIOS is the firmware type BIOS
+	FirmwareBIOS = "bios"
+	// FirmwareEFI is the firmware type EFI
+	FirmwareEFI = "efi"
+
+	// LatencySensitivityLow is the latency sensitivity level low
+	LatencySensitivityLow = "low"
+	// LatencySensitivityNormal is the latency sensitivity level normal
+	LatencySensitivityNormal = "normal"
+	// LatencySensitivityHigh is the latency sensitivity level high
+	LatencySensitivityHigh = "high"
+)
+
+// VSphereBootstrap specifies how the user data is provided to the VM
+type VSphereBootstrap struct {
+	// Format is the bootstrap format (ignition, cloud-init-vapp, cloud-init-guestinfo, customization, raw-vapp or nocloud-iso).
+	// If not set, it is derived from the guest ID: ignition for CoreOS and Flatcar, cloud-init-vapp otherwise.
+	// +optional
+	Format string `json:"format,omitempty"`
+	// IgnitionVersion is the spec version of generated Ignition configs, e.g. 2.3.0 or 3.3.0 (defaults to 2.1.0,
+	// or to the version of the user data if it is an Ignition config itself).
+	// +optional
+	IgnitionVersion string `json:"ignitionVersion,omitempty"`
+	// TemplateUserData enables rendering the user data as template with the per-machine variables
+	// like in vApp properties and extra config values
+	// +optional
+	TemplateUserData bool `json:"templateUserData,omitempty"`
+}
+
+const (
+	// BootstrapFormatIgnition provides an Ignition config as vApp property guestinfo.ignition.config.data
+	BootstrapFormatIgnition = "ignition"
+	// BootstrapFormatCloudInitVApp provides the cloud-init user data as vApp properties (OVF datasource)
+	BootstrapFormatCloudInitVApp = "cloud-init-vapp"
+	// BootstrapFormatCloudInitGuestInfo provides the cloud-init user data and metadata as guestinfo extra config (VMware datasource)
+	BootstrapFormatCloudInitGuestInfo = "cloud-init-guestinfo"
+	// BootstrapFormatCustomization provides the cloud-init user data by guest customization
+	BootstrapFormatCustomization = "customization"
+	// BootstrapFormatRawVApp provides the user data unmodified as vApp property user-data
+	BootstrapFormatRawVApp = "raw-vapp"
+	// BootstrapFormatNoCloudISO provides the cloud-init user data on a seed ISO image attached as CD-ROM (NoCloud datasource)
+	BootstrapFormatNoCloudISO = "nocloud-iso"
+)
+
+// GuestInfoIdentityPrefix is the prefix of the guestinfo keys with the machine identity (machine name, provider ID,
+// placement), which are set by the provider on every VM and can be read in the guest with
+// `vmtoolsd --cmd "info-get guestinfo.mcm.<name>"`
+const GuestInfoIdentityPrefix = "guestinfo.mcm."
+
+// SupportedBootstrapFormats are the supported bootstrap formats
+var SupportedBootstrapFormats = []string{
+	BootstrapFormatIgnition,
+	BootstrapFormatCloudInitVApp,
+	BootstrapFormatCloudInitGuestInfo,
+	BootstrapFormatCustomization,
+	BootstrapFormatRawVApp,
+	BootstrapFormatNoCloudISO,
+}
+
+// IsSupportedBootstrapFormat checks if the bootstrap format is supported
+func IsSupportedBootstrapFormat(format string) bool {
+	for _, f := range SupportedBootstrapFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultIgnitionVersion is the default spec version of generated Ignition configs
+const DefaultIgnitionVersion = "2.1.0"
+
+// SupportedIgnitionVersions are the supported spec versions of generated Ignition configs
+var SupportedIgnitionVersions = []string{"2.1.0", "2.2.0", "2.3.0", "3.0.0", "3.1.0", "3.2.0", "3.3.0", "3.4.0"}
+
+// IsSupportedIgnitionVersion checks if the Ignition spec version is supported
+func IsSupportedIgnitionVersion(version string) bool {
+	for _, v := range SupportedIgnitionVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
 }
 
 // VSphereSystemDisk specifies system disk of a machine
@@ -104,8 +353,117 @@ type VSphereSystemDisk struct {
 	Size int `json:"size"`
 }
 
+// VSphereDataDisk specifies an additional disk of a machine
+type VSphereDataDisk struct {
+	// Size is disk size in GB
+	Size int `json:"size"`
+	// Datastore is the data store to place the disk on (defaults to the data store of the VM)
+	// +optional
+	Datastore string `json:"datastore,omitempty"`
+	// StoragePolicy is the name of the VM storage policy applied to the disk (defaults to the storage policy of the VM)
+	// +optional
+	StoragePolicy string `json:"storagePolicy,omitempty"`
+	// ProvisioningType is the provisioning type of the disk: thin (default), thick or eagerZeroedThick
+	// +optional
+	ProvisioningType string `json:"provisioningType,omitempty"`
+	// DiskMode is the disk mode: persistent (default), independent_persistent or independent_nonpersistent
+	// +optional
+	DiskMode string `json:"diskMode,omitempty"`
+	// ControllerType is the type of the controller the disk is attached to: scsi (default), nvme or sata
+	// +optional
+	ControllerType string `json:"controllerType,omitempty"`
+	// ControllerBusNumber is the bus number of the controller the disk is attached to (default 0).
+	// The controller is created if it does not exist.
+	// +optional
+	ControllerBusNumber *int `json:"controllerBusNumber,omitempty"`
+}
+
+const (
+	// ProvisioningTypeThin is the provisioning type for thin provisioned disks
+	ProvisioningTypeThin = "thin"
+	// ProvisioningTypeThick is the provisioning type for lazy zeroed thick provisioned disks
+	ProvisioningTypeThick = "thick"
+	// ProvisioningTypeEagerZeroedThick is the provisioning type for eager zeroed thick provisioned disks
+	ProvisioningTypeEagerZeroedThick = "eagerZeroedThick"
+
+	// ControllerTypeSCSI is the controller type for (paravirtual) SCSI controllers
+	ControllerTypeSCSI = "scsi"
+	// ControllerTypeNVME is the controller type for NVMe controllers
+	ControllerTypeNVME = "nvme"
+	// ControllerTypeSATA is the controller type for SATA (AHCI) controllers
+	ControllerTypeSATA = "sata"
+)
+
+// VSphereNetworkInterface specifies a network interface of a machine
+type VSphereNetworkInterface struct {
+	// Name is the vSphere network to use
+	Name string `json:"name"`
+	// SwitchUUID is VDS UUID (only needed if there are multiple virtual distributed switches the network is assigned to)
+	// +optional
+	SwitchUUID string `json:"switchUuid,omitempty"`
+	// AdapterType is the type of the virtual network adapter (e.g. vmxnet3, e1000e, e1000).
+	// If not set, the type of the matching template network card is kept and new cards are created as vmxnet3.
+	// +optional
+	AdapterType string `json:"adapterType,omitempty"`
+	// IPAddresses are the static IP addresses in CIDR notation (e.g. 10.0.0.10/24). DHCP is used if neither
+	// IPAddresses nor IPPool is set.
+	// +optional
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	// IPPool is the pool to allocate a static IP address from for each machine (mutually exclusive with IPAddresses)
+	// +optional
+	IPPool *VSphereIPPool `json:"ipPool,omitempty"`
+	// Gateways are the default gateways of the static IP addresses
+	// +optional
+	Gateways []string `json:"gateways,omitempty"`
+	// Nameservers are the DNS servers to use for the interface
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+	// SearchDomains are the DNS search domains to use for the interface
+	// +optional
+	SearchDomains []string `json:"searchDomains,omitempty"`
+}
+
+// VSphereIPPool specifies a pool of IP addresses.
+// The allocated address is recorded as custom attribute on the VM, so all VMs using the pool
+// must be placed in the same folder.
+type VSphereIPPool struct {
+	// Ranges are the IP ranges (e.g. 10.0.0.10-10.0.0.50) or CIDRs (e.g. 10.0.0.0/24) of the pool.
+	// A range must not be larger than a /64 network.
+	Ranges []string `json:"ranges"`
+	// Excludes are IP addresses, ranges or CIDRs not to be allocated (e.g. the gateway)
+	// +optional
+	Excludes []string `json:"excludes,omitempty"`
+	// PrefixLength is the prefix length of the network of the allocated addresses (e.g. 24)
+	PrefixLength int `json:"prefixLength"`
+}
+
 // VApp contains the properties of the VApp
 type VApp struct {
-	// Properties are the properties values of the VApp
+	// Properties are the properties values of the VApp.
+	// The values may contain templates with the variables {{ .MachineName }}, {{ .Region }}, {{ .Datacenter }},
+	// {{ .Role }} and {{ .ClusterName }}.
 	Properties map[string]string `json:"properties"`
+	// PropertiesFrom are properties values taken from the secret, e.g. for credentials
+	// +optional
+	PropertiesFrom map[string]VSphereValueSource `json:"propertiesFrom,omitempty"`
+}
+
+// VSphereValueSource specifies the source of a value
+type VSphereValueSource struct {
+	// SecretKey is the key of the value in the secret of the machine class.
+	// The vSphere credentials and the user data cannot be used, see ProtectedSecretKeys.
+	SecretKey string `json:"secretKey"`
+}
+
+// ProtectedSecretKeys are the keys of the secret which must not be passed to the guest as value source
+var ProtectedSecretKeys = []string{"vsphereHost", "vsphereUsername", "vspherePassword", "vsphereInsecureSSL", "userData"}
+
+// IsProtectedSecretKey checks if the key of the secret must not be passed to the guest
+func IsProtectedSecretKey(key string) bool {
+	for _, k := range ProtectedSecretKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
 }
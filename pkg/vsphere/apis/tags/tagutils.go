@@ -71,6 +71,16 @@ func NewRelevantTags(tags map[string]string) (*RelevantTags, []error) {
 	}, nil
 }
 
+// ClusterName returns the cluster name
+func (t *RelevantTags) ClusterName() string {
+	return t.clusterName
+}
+
+// Role returns the node role
+func (t *RelevantTags) Role() string {
+	return t.nodeRole
+}
+
 // Matches checks if given tags matches cluster name and role
 func (t *RelevantTags) Matches(tags map[string]string) bool {
 	matchedCluster := false
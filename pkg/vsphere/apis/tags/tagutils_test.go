@@ -75,6 +75,8 @@ func TestNewTags(t *testing.T) {
 	g.Expect(tags.Matches(oldSpecTags2)).To(gomega.Equal(false))
 	g.Expect(tags.Matches(newSpecTags)).To(gomega.Equal(true))
 	g.Expect(tags.Matches(newSpecTags2)).To(gomega.Equal(false))
+	g.Expect(tags.ClusterName()).To(gomega.Equal(cluster1))
+	g.Expect(tags.Role()).To(gomega.Equal(role))
 }
 
 func TestEmptyTags(t *testing.T) {
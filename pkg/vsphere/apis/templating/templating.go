@@ -0,0 +1,122 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+// Package templating renders per-machine values into vApp properties, extra config values and user data.
+package templating
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/tags"
+)
+
+// Variables are the values available in templates by name, e.g. `{{ .MachineName }}`
+type Variables map[string]string
+
+// VariablesFor returns the variables of the machine
+func VariablesFor(machineName string, spec *api.VsphereProviderSpec) Variables {
+	vars := Variables{
+		"MachineName": machineName,
+		"Region":      spec.Region,
+		"Datacenter":  spec.Datacenter,
+		"Role":        "",
+		"ClusterName": "",
+	}
+	if relevantTags, _ := tags.NewRelevantTags(spec.Tags); relevantTags != nil {
+		vars["ClusterName"] = relevantTags.ClusterName()
+		vars["Role"] = relevantTags.Role()
+	}
+	return vars
+}
+
+// Render renders the text with the variables. Text without actions is returned unchanged.
+// Only plain variable references like `{{ .MachineName }}` are allowed, unknown variables result in an error.
+func Render(text string, vars Variables) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	if err = checkNodes(tmpl.Root); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, map[string]string(vars)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// checkNodes rejects all actions except variable references, i.e. functions, pipelines, conditions and loops
+func checkNodes(list *parse.ListNode) error {
+	for _, node := range list.Nodes {
+		if _, ok := node.(*parse.TextNode); ok {
+			continue
+		}
+		if !isVariable(node) {
+			return fmt.Errorf("unsupported action %s, only variables like {{ .MachineName }} are allowed", node)
+		}
+	}
+	return nil
+}
+
+// isVariable checks if the node is an action like `{{ .MachineName }}`
+func isVariable(node parse.Node) bool {
+	action, ok := node.(*parse.ActionNode)
+	if !ok || len(action.Pipe.Decl) > 0 || len(action.Pipe.Cmds) != 1 || len(action.Pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	field, ok := action.Pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok && len(field.Ident) == 1
+}
+
+// Validate checks that the text can be rendered with the known variables
+func Validate(text string) error {
+	_, err := Render(text, VariablesFor("", &api.VsphereProviderSpec{}))
+	return err
+}
+
+// RenderMap renders the values of the map and returns a new map
+func RenderMap(values map[string]string, vars Variables) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	result := make(map[string]string, len(values))
+	for key, value := range values {
+		rendered, err := Render(value, vars)
+		if err != nil {
+			return nil, &KeyError{Key: key, Err: err}
+		}
+		result[key] = rendered
+	}
+	return result, nil
+}
+
+// KeyError is the error of rendering the value of a map key
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
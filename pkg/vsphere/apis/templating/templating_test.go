@@ -0,0 +1,76 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package templating
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestRender(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	vars := VariablesFor("machine1", &api.VsphereProviderSpec{
+		Region:     "region1",
+		Datacenter: "dc1",
+		Tags: map[string]string{
+			"kubernetes.io/cluster/shoot--foo--bar": "1",
+			"kubernetes.io/role/node":               "1",
+		},
+	})
+	g.Expect(vars).To(gomega.Equal(Variables{"MachineName": "machine1", "Region": "region1", "Datacenter": "dc1", "Role": "node", "ClusterName": "shoot--foo--bar"}))
+
+	result, err := Render("{{ .MachineName }}.{{ .ClusterName }}.{{ .Region }}", vars)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(result).To(gomega.Equal("machine1.shoot--foo--bar.region1"))
+
+	result, err = Render("no template", vars)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(result).To(gomega.Equal("no template"))
+
+	values, err := RenderMap(map[string]string{"guestinfo.machine": "{{ .MachineName }}"}, vars)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(values).To(gomega.Equal(map[string]string{"guestinfo.machine": "machine1"}))
+
+	g.Expect(Validate("{{ .Role }}")).To(gomega.Succeed())
+	g.Expect(Validate("{{ .Unknown }}")).NotTo(gomega.Succeed())
+	g.Expect(Validate("{{ .Role ")).NotTo(gomega.Succeed())
+	_, err = RenderMap(map[string]string{"key1": "{{ .Unknown }}"}, vars)
+	g.Expect(err).To(gomega.MatchError(gomega.HavePrefix("key1: ")))
+}
+
+func TestRenderRejectsActions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	vars := VariablesFor("machine1", &api.VsphereProviderSpec{})
+	for _, text := range []string{
+		`{{ printf "%s" .MachineName }}`,
+		`{{ call .MachineName }}`,
+		`{{ .MachineName | len }}`,
+		`{{ .MachineName.Foo }}`,
+		`{{ $x := .MachineName }}`,
+		`{{ if .Role }}worker{{ end }}`,
+		`{{ range .Role }}{{ end }}`,
+		`{{ template "foo" }}`,
+		`{{ . }}`,
+	} {
+		_, err := Render(text, vars)
+		g.Expect(err).To(gomega.HaveOccurred(), text)
+	}
+}
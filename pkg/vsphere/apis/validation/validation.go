@@ -18,33 +18,346 @@ package validation
 
 import (
 	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
 
 	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/contentlibrary"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/ippool"
 	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/tags"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/templating"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
+var hardwareVersionRegexp = regexp.MustCompile(`^vmx-[0-9]+$`)
+
+// passwordHashRegexp matches crypt hashes like $6$<salt>$<hash> or $6$rounds=<n>$<salt>$<hash>
+var passwordHashRegexp = regexp.MustCompile(`^\$[0-9a-z]+\$[^$\s]+(\$[^$\s]+)+$`)
+
+// maxIPRangeSize is the maximum number of addresses of an IP pool range (a /64 network)
+var maxIPRangeSize = new(big.Int).Lsh(big.NewInt(1), 64)
+
 // ValidateVsphereProviderSpec validates Vsphere provider spec
 func ValidateVsphereProviderSpec(spec *api.VsphereProviderSpec, secrets *corev1.Secret) []error {
 	var allErrs []error
 
-	if "" == spec.Datastore && "" == spec.DatastoreCluster {
-		allErrs = append(allErrs, fmt.Errorf("either datastoreCluster or datastore field is required"))
+	if "" == spec.Datastore && "" == spec.DatastoreCluster && "" == spec.StoragePolicy {
+		allErrs = append(allErrs, fmt.Errorf("either datastoreCluster or datastore or storagePolicy field is required"))
 	}
 	if "" == spec.TemplateVM {
 		allErrs = append(allErrs, fmt.Errorf("templateVM is a required field"))
 	}
+	if _, err := contentlibrary.ParseTemplate(spec.TemplateVM); err != nil {
+		allErrs = append(allErrs, fmt.Errorf("templateVM: %s", err))
+	}
+	allErrs = append(allErrs, validateLinkedClone(spec)...)
 	if "" == spec.ComputeCluster && "" == spec.ResourcePool && "" == spec.HostSystem {
 		allErrs = append(allErrs, fmt.Errorf("either computeCluster or resourcePool or hostSystem field is required"))
 	}
-	if "" == spec.Network {
-		allErrs = append(allErrs, fmt.Errorf("network is a required field"))
+	if "" == spec.Network && len(spec.Networks) == 0 {
+		allErrs = append(allErrs, fmt.Errorf("either network or networks field is required"))
+	}
+	if "" != spec.Network && len(spec.Networks) > 0 {
+		allErrs = append(allErrs, fmt.Errorf("network and networks fields are mutually exclusive"))
 	}
+	allErrs = append(allErrs, validateNetworks(spec.Networks)...)
+	allErrs = append(allErrs, validateDataDisks(spec.DataDisks)...)
 
 	allErrs = append(allErrs, validateSecrets(secrets)...)
 	_, tagErrs := tags.NewRelevantTags(spec.Tags)
 	allErrs = append(allErrs, tagErrs...)
+	allErrs = append(allErrs, validateTagMode(spec)...)
+	allErrs = append(allErrs, validateHostGroupAffinity(spec)...)
+	allErrs = append(allErrs, validateCPUTopology(spec)...)
+	allErrs = append(allErrs, validateFirmware(spec)...)
+	allErrs = append(allErrs, validateBootstrap(spec)...)
+	allErrs = append(allErrs, validateConsoleCredentials(spec, secrets)...)
+	allErrs = append(allErrs, validateTemplates(spec, secrets)...)
+	if spec.VApp != nil {
+		allErrs = append(allErrs, validateValueSources("vapp.propertiesFrom", spec.VApp.PropertiesFrom, spec.VApp.Properties, secrets)...)
+	}
+	allErrs = append(allErrs, validateValueSources("extraConfigFrom", spec.ExtraConfigFrom, spec.ExtraConfig, secrets)...)
+	allErrs = append(allErrs, validateExtraConfigKeys(spec)...)
+	switch spec.HardwareVersion {
+	case "", api.HardwareVersionLatest, api.HardwareVersionKeep:
+	default:
+		if !hardwareVersionRegexp.MatchString(spec.HardwareVersion) {
+			allErrs = append(allErrs, fmt.Errorf("hardwareVersion %q is not supported, expected vmx-NN, %s or %s", spec.HardwareVersion, api.HardwareVersionLatest, api.HardwareVersionKeep))
+		}
+	}
+	allErrs = append(allErrs, validateResourceAllocation("cpuAllocation", spec.CPUAllocation)...)
+	allErrs = append(allErrs, validateResourceAllocation("memoryAllocation", spec.MemoryAllocation)...)
+	if memory := spec.MemoryAllocation; memory != nil && memory.Reservation != nil {
+		if spec.MemoryReservationLockedToMax != nil && *spec.MemoryReservationLockedToMax {
+			allErrs = append(allErrs, fmt.Errorf("memoryAllocation.reservation and memoryReservationLockedToMax are mutually exclusive"))
+		}
+		if spec.Memory > 0 && *memory.Reservation > int64(spec.Memory) {
+			allErrs = append(allErrs, fmt.Errorf("memoryAllocation.reservation %d must not exceed memory %d", *memory.Reservation, spec.Memory))
+		}
+	}
+	if spec.AntiAffinity != nil {
+		if "" == spec.ComputeCluster {
+			allErrs = append(allErrs, fmt.Errorf("antiAffinity requires computeCluster"))
+		}
+		if key := spec.AntiAffinity.GroupKey; "" != key && "" == spec.Tags[key] {
+			allErrs = append(allErrs, fmt.Errorf("antiAffinity.groupKey: tag %q not found", key))
+		}
+	}
+
+	return allErrs
+}
+
+// validateLinkedClone checks the linked clone settings as far as possible without the template.
+// The snapshot of the template is only checked on creating the VM.
+func validateLinkedClone(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	if "" != spec.TemplateSnapshot && !spec.LinkedClone {
+		allErrs = append(allErrs, fmt.Errorf("templateSnapshot requires linkedClone"))
+	}
+	if spec.LinkedClone && contentlibrary.IsLibraryTemplate(spec.TemplateVM) {
+		allErrs = append(allErrs, fmt.Errorf("linkedClone is not supported for content library templates"))
+	}
+
+	return allErrs
+}
+
+func validateTagMode(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	switch spec.TagMode {
+	case "", api.TagModeCustomAttributes:
+	case api.TagModeVSphereTags, api.TagModeBoth:
+		for key, value := range spec.Tags {
+			if "" == value {
+				allErrs = append(allErrs, fmt.Errorf("tags: value of tag %q must not be empty for tagMode %s", key, spec.TagMode))
+			}
+		}
+	default:
+		allErrs = append(allErrs, fmt.Errorf("tagMode %q is not supported", spec.TagMode))
+	}
+
+	return allErrs
+}
+
+func validateHostGroupAffinity(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	affinity := spec.HostGroupAffinity
+	if affinity == nil {
+		return nil
+	}
+	if "" == spec.ComputeCluster {
+		allErrs = append(allErrs, fmt.Errorf("hostGroupAffinity requires computeCluster"))
+	}
+	if "" == affinity.HostGroup {
+		allErrs = append(allErrs, fmt.Errorf("hostGroupAffinity.hostGroup is a required field"))
+	}
+	if "" == affinity.VMGroup {
+		allErrs = append(allErrs, fmt.Errorf("hostGroupAffinity.vmGroup is a required field"))
+	}
+	switch affinity.RuleType {
+	case "", api.HostGroupRuleTypeMust, api.HostGroupRuleTypeShould:
+	default:
+		allErrs = append(allErrs, fmt.Errorf("hostGroupAffinity.ruleType %q is not supported", affinity.RuleType))
+	}
+
+	return allErrs
+}
+
+func validateCPUTopology(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	if spec.CoresPerSocket < 0 {
+		allErrs = append(allErrs, fmt.Errorf("coresPerSocket must not be negative"))
+	} else if spec.CoresPerSocket > 0 && spec.NumCpus > 0 && spec.NumCpus%spec.CoresPerSocket != 0 {
+		allErrs = append(allErrs, fmt.Errorf("numCpus %d must be divisible by coresPerSocket %d", spec.NumCpus, spec.CoresPerSocket))
+	}
+	if numa := spec.NUMA; numa != nil {
+		if numa.MaxVCPUsPerNode < 0 {
+			allErrs = append(allErrs, fmt.Errorf("numa.maxVcpusPerNode must not be negative"))
+		}
+		if numa.MinVCPUs < 0 {
+			allErrs = append(allErrs, fmt.Errorf("numa.minVcpus must not be negative"))
+		}
+	}
+	switch spec.LatencySensitivity {
+	case "", api.LatencySensitivityLow, api.LatencySensitivityNormal:
+	case api.LatencySensitivityHigh:
+		lockedToMax := spec.MemoryReservationLockedToMax != nil && *spec.MemoryReservationLockedToMax
+		fullReservation := spec.MemoryAllocation != nil && spec.MemoryAllocation.Reservation != nil &&
+			spec.Memory > 0 && *spec.MemoryAllocation.Reservation == int64(spec.Memory)
+		if !lockedToMax && !fullReservation {
+			allErrs = append(allErrs, fmt.Errorf("latencySensitivity %s requires memoryReservationLockedToMax or a full memory reservation", api.LatencySensitivityHigh))
+		}
+	default:
+		allErrs = append(allErrs, fmt.Errorf("latencySensitivity %q is not supported", spec.LatencySensitivity))
+	}
+
+	return allErrs
+}
+
+func validateFirmware(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+
+	switch spec.Firmware {
+	case "", api.FirmwareBIOS, api.FirmwareEFI:
+	default:
+		allErrs = append(allErrs, fmt.Errorf("firmware %q is not supported", spec.Firmware))
+	}
+	// the firmware of the template is unknown at validation time, therefore efi must be set explicitly
+	secureBoot := spec.SecureBoot != nil && *spec.SecureBoot
+	if secureBoot && spec.Firmware != api.FirmwareEFI {
+		allErrs = append(allErrs, fmt.Errorf("secureBoot requires firmware %s", api.FirmwareEFI))
+	}
+	if spec.VBS != nil && *spec.VBS {
+		if spec.Firmware != api.FirmwareEFI {
+			allErrs = append(allErrs, fmt.Errorf("vbs requires firmware %s", api.FirmwareEFI))
+		}
+		if !secureBoot {
+			allErrs = append(allErrs, fmt.Errorf("vbs requires secureBoot"))
+		}
+		if spec.NestedHV != nil && !*spec.NestedHV {
+			allErrs = append(allErrs, fmt.Errorf("vbs requires nestedHV"))
+		}
+	}
+
+	return allErrs
+}
+
+func validateResourceAllocation(fieldName string, allocation *api.VSphereResourceAllocation) []error {
+	var allErrs []error
+
+	if allocation == nil {
+		return nil
+	}
+	if allocation.Reservation != nil && *allocation.Reservation < 0 {
+		allErrs = append(allErrs, fmt.Errorf("%s.reservation must not be negative", fieldName))
+	}
+	if allocation.Limit != nil && *allocation.Limit < -1 {
+		allErrs = append(allErrs, fmt.Errorf("%s.limit must be -1 (unlimited) or not negative", fieldName))
+	}
+	if allocation.Reservation != nil && allocation.Limit != nil && *allocation.Limit >= 0 && *allocation.Reservation > *allocation.Limit {
+		allErrs = append(allErrs, fmt.Errorf("%s.reservation %d must not exceed limit %d", fieldName, *allocation.Reservation, *allocation.Limit))
+	}
+	switch allocation.Shares {
+	case "", api.SharesLevelLow, api.SharesLevelNormal, api.SharesLevelHigh:
+		if allocation.CustomShares != 0 {
+			allErrs = append(allErrs, fmt.Errorf("%s.customShares requires shares level %s", fieldName, api.SharesLevelCustom))
+		}
+	case api.SharesLevelCustom:
+		if allocation.CustomShares <= 0 {
+			allErrs = append(allErrs, fmt.Errorf("%s.customShares must be greater than 0 for shares level %s", fieldName, api.SharesLevelCustom))
+		}
+	default:
+		allErrs = append(allErrs, fmt.Errorf("%s.shares %q is not supported", fieldName, allocation.Shares))
+	}
+
+	return allErrs
+}
+
+func validateNetworks(networks []api.VSphereNetworkInterface) []error {
+	var allErrs []error
+
+	for i, nic := range networks {
+		if "" == nic.Name {
+			allErrs = append(allErrs, fmt.Errorf("networks[%d].name is a required field", i))
+		}
+		switch nic.AdapterType {
+		case "", "e1000", "e1000e", "vmxnet2", "vmxnet3", "vmxnet3vrdma", "pcnet32", "sriov":
+		default:
+			allErrs = append(allErrs, fmt.Errorf("networks[%d].adapterType %q is not supported", i, nic.AdapterType))
+		}
+		for _, address := range nic.IPAddresses {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				allErrs = append(allErrs, fmt.Errorf("networks[%d].ipAddresses: %q is not in CIDR notation", i, address))
+			}
+		}
+		if len(nic.IPAddresses) > 0 && nic.IPPool != nil {
+			allErrs = append(allErrs, fmt.Errorf("networks[%d]: ipAddresses and ipPool are mutually exclusive", i))
+		}
+		if nic.IPPool != nil {
+			allErrs = append(allErrs, validateIPPool(fmt.Sprintf("networks[%d].ipPool", i), nic.IPPool)...)
+		}
+		if len(nic.Gateways) > 0 && len(nic.IPAddresses) == 0 && nic.IPPool == nil {
+			allErrs = append(allErrs, fmt.Errorf("networks[%d].gateways requires ipAddresses or ipPool", i))
+		}
+		for _, gateway := range nic.Gateways {
+			if net.ParseIP(gateway) == nil {
+				allErrs = append(allErrs, fmt.Errorf("networks[%d].gateways: %q is not a valid IP address", i, gateway))
+			}
+		}
+		for _, nameserver := range nic.Nameservers {
+			if net.ParseIP(nameserver) == nil {
+				allErrs = append(allErrs, fmt.Errorf("networks[%d].nameservers: %q is not a valid IP address", i, nameserver))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+func validateDataDisks(disks []api.VSphereDataDisk) []error {
+	var allErrs []error
+
+	for i, disk := range disks {
+		if disk.Size <= 0 {
+			allErrs = append(allErrs, fmt.Errorf("dataDisks[%d].size must be greater than 0", i))
+		}
+		switch disk.ProvisioningType {
+		case "", api.ProvisioningTypeThin, api.ProvisioningTypeThick, api.ProvisioningTypeEagerZeroedThick:
+		default:
+			allErrs = append(allErrs, fmt.Errorf("dataDisks[%d].provisioningType %q is not supported", i, disk.ProvisioningType))
+		}
+		switch disk.DiskMode {
+		case "", "persistent", "independent_persistent", "independent_nonpersistent":
+		default:
+			allErrs = append(allErrs, fmt.Errorf("dataDisks[%d].diskMode %q is not supported", i, disk.DiskMode))
+		}
+		switch disk.ControllerType {
+		case "", api.ControllerTypeSCSI, api.ControllerTypeNVME, api.ControllerTypeSATA:
+		default:
+			allErrs = append(allErrs, fmt.Errorf("dataDisks[%d].controllerType %q is not supported", i, disk.ControllerType))
+		}
+		if disk.ControllerBusNumber != nil && (*disk.ControllerBusNumber < 0 || *disk.ControllerBusNumber > 3) {
+			allErrs = append(allErrs, fmt.Errorf("dataDisks[%d].controllerBusNumber must be between 0 and 3", i))
+		}
+	}
+
+	return allErrs
+}
+
+func validateIPPool(path string, pool *api.VSphereIPPool) []error {
+	var allErrs []error
+
+	if len(pool.Ranges) == 0 {
+		allErrs = append(allErrs, fmt.Errorf("%s.ranges is a required field", path))
+	}
+	maxPrefixLength := 128
+	for _, r := range pool.Ranges {
+		parsed, err := ippool.ParseRange(r)
+		if err != nil {
+			allErrs = append(allErrs, fmt.Errorf("%s.ranges: %s", path, err))
+			continue
+		}
+		if parsed.First.Is4() {
+			maxPrefixLength = 32
+		}
+		if parsed.Size().Cmp(maxIPRangeSize) > 0 {
+			allErrs = append(allErrs, fmt.Errorf("%s.ranges: IP range %q is larger than a /64 network", path, r))
+		}
+	}
+	for _, r := range pool.Excludes {
+		if _, err := ippool.ParseRange(r); err != nil {
+			allErrs = append(allErrs, fmt.Errorf("%s.excludes: %s", path, err))
+		}
+	}
+	if pool.PrefixLength <= 0 || pool.PrefixLength > maxPrefixLength {
+		allErrs = append(allErrs, fmt.Errorf("%s.prefixLength must be between 1 and %d", path, maxPrefixLength))
+	}
 
 	return allErrs
 }
@@ -72,7 +385,114 @@ func validateSecrets(secret *corev1.Secret) []error {
 		if !userDataExists {
 			allErrs = append(allErrs, fmt.Errorf("Secret userData is required field"))
 		}
+		consolePassword, consolePasswordExists := secret.Data["consolePassword"]
+		consolePasswordHash, consolePasswordHashExists := secret.Data["consolePasswordHash"]
+		if consolePasswordExists && consolePasswordHashExists {
+			allErrs = append(allErrs, fmt.Errorf("Secret consolePassword and consolePasswordHash are mutually exclusive"))
+		}
+		if consolePasswordExists && len(consolePassword) == 0 {
+			allErrs = append(allErrs, fmt.Errorf("Secret consolePassword must not be empty"))
+		}
+		if consolePasswordHashExists && !passwordHashRegexp.Match(consolePasswordHash) {
+			allErrs = append(allErrs, fmt.Errorf("Secret consolePasswordHash must be a crypt hash like $6$<salt>$<hash>"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateConsoleCredentials rejects console credentials for bootstrap formats which cannot apply them
+func validateConsoleCredentials(spec *api.VsphereProviderSpec, secret *corev1.Secret) []error {
+	if secret == nil || spec.Bootstrap == nil {
+		return nil
+	}
+	_, passwordExists := secret.Data["consolePassword"]
+	_, passwordHashExists := secret.Data["consolePasswordHash"]
+
+	var allErrs []error
+	switch spec.Bootstrap.Format {
+	case "", api.BootstrapFormatIgnition:
+	case api.BootstrapFormatCloudInitVApp:
+		if passwordHashExists {
+			allErrs = append(allErrs, fmt.Errorf("Secret consolePasswordHash is not supported with bootstrap.format %s, use consolePassword", spec.Bootstrap.Format))
+		}
+	default:
+		if passwordExists || passwordHashExists {
+			allErrs = append(allErrs, fmt.Errorf("Secret consolePassword and consolePasswordHash are not supported with bootstrap.format %s", spec.Bootstrap.Format))
+		}
 	}
+	return allErrs
+}
 
+func validateBootstrap(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+	if spec.Bootstrap == nil {
+		return allErrs
+	}
+	if "" != spec.Bootstrap.Format && !api.IsSupportedBootstrapFormat(spec.Bootstrap.Format) {
+		allErrs = append(allErrs, fmt.Errorf("bootstrap.format %q is not supported, supported formats are %v", spec.Bootstrap.Format, api.SupportedBootstrapFormats))
+	}
+	if "" != spec.Bootstrap.IgnitionVersion && !api.IsSupportedIgnitionVersion(spec.Bootstrap.IgnitionVersion) {
+		allErrs = append(allErrs, fmt.Errorf("bootstrap.ignitionVersion %q is not supported, supported versions are %v", spec.Bootstrap.IgnitionVersion, api.SupportedIgnitionVersions))
+	}
+	if spec.Bootstrap.Format == api.BootstrapFormatCustomization && spec.VApp != nil {
+		allErrs = append(allErrs, fmt.Errorf("bootstrap.format %q cannot be combined with vapp", spec.Bootstrap.Format))
+	}
+	return allErrs
+}
+
+func validateTemplates(spec *api.VsphereProviderSpec, secret *corev1.Secret) []error {
+	var allErrs []error
+	if spec.VApp != nil {
+		for key, value := range spec.VApp.Properties {
+			if err := templating.Validate(value); err != nil {
+				allErrs = append(allErrs, fmt.Errorf("vapp.properties[%s]: invalid template: %s", key, err))
+			}
+		}
+	}
+	for key, value := range spec.ExtraConfig {
+		if err := templating.Validate(value); err != nil {
+			allErrs = append(allErrs, fmt.Errorf("extraConfig[%s]: invalid template: %s", key, err))
+		}
+	}
+	if spec.Bootstrap != nil && spec.Bootstrap.TemplateUserData && secret != nil {
+		if err := templating.Validate(string(secret.Data["userData"])); err != nil {
+			allErrs = append(allErrs, fmt.Errorf("Secret userData: invalid template: %s", err))
+		}
+	}
+	return allErrs
+}
+
+func validateExtraConfigKeys(spec *api.VsphereProviderSpec) []error {
+	var allErrs []error
+	for key := range spec.ExtraConfig {
+		if strings.HasPrefix(key, api.GuestInfoIdentityPrefix) {
+			allErrs = append(allErrs, fmt.Errorf("extraConfig[%s]: prefix %s is reserved for the machine identity", key, api.GuestInfoIdentityPrefix))
+		}
+	}
+	for key := range spec.ExtraConfigFrom {
+		if strings.HasPrefix(key, api.GuestInfoIdentityPrefix) {
+			allErrs = append(allErrs, fmt.Errorf("extraConfigFrom[%s]: prefix %s is reserved for the machine identity", key, api.GuestInfoIdentityPrefix))
+		}
+	}
+	return allErrs
+}
+
+func validateValueSources(fieldName string, sources map[string]api.VSphereValueSource, values map[string]string, secret *corev1.Secret) []error {
+	var allErrs []error
+	for key, source := range sources {
+		if _, ok := values[key]; ok {
+			allErrs = append(allErrs, fmt.Errorf("%s[%s]: key is also specified with a value", fieldName, key))
+		}
+		if "" == source.SecretKey {
+			allErrs = append(allErrs, fmt.Errorf("%s[%s].secretKey is required", fieldName, key))
+		} else if api.IsProtectedSecretKey(source.SecretKey) {
+			allErrs = append(allErrs, fmt.Errorf("%s[%s]: Secret %s must not be passed to the VM", fieldName, key, source.SecretKey))
+		} else if secret != nil {
+			if _, ok := secret.Data[source.SecretKey]; !ok {
+				allErrs = append(allErrs, fmt.Errorf("%s[%s]: Secret %s not found", fieldName, key, source.SecretKey))
+			}
+		}
+	}
 	return allErrs
 }
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package validation
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestValidateLinkedClone(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(validateLinkedClone(&api.VsphereProviderSpec{TemplateVM: "template", LinkedClone: true, TemplateSnapshot: "v1"})).To(gomega.BeEmpty())
+	g.Expect(validateLinkedClone(&api.VsphereProviderSpec{TemplateVM: "library:images/ubuntu"})).To(gomega.BeEmpty())
+
+	errs := validateLinkedClone(&api.VsphereProviderSpec{TemplateVM: "library:images/ubuntu", LinkedClone: true})
+	g.Expect(errs).To(gomega.ConsistOf(gomega.MatchError("linkedClone is not supported for content library templates")))
+
+	errs = validateLinkedClone(&api.VsphereProviderSpec{TemplateVM: "template", TemplateSnapshot: "v1"})
+	g.Expect(errs).To(gomega.ConsistOf(gomega.MatchError("templateSnapshot requires linkedClone")))
+}
+
+func TestValidateIPPool(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(validateIPPool("networks[0].ipPool", &api.VSphereIPPool{Ranges: []string{"10.0.0.0/24"}, PrefixLength: 24})).To(gomega.BeEmpty())
+	g.Expect(validateIPPool("networks[0].ipPool", &api.VSphereIPPool{Ranges: []string{"fd00::/120"}, PrefixLength: 64})).To(gomega.BeEmpty())
+
+	errs := validateIPPool("networks[0].ipPool", &api.VSphereIPPool{Ranges: []string{"10.0.0.0/24"}, PrefixLength: 64})
+	g.Expect(errs).To(gomega.ConsistOf(gomega.MatchError("networks[0].ipPool.prefixLength must be between 1 and 32")))
+
+	g.Expect(validateIPPool("networks[0].ipPool", &api.VSphereIPPool{Ranges: []string{"fd00::/64"}, PrefixLength: 64})).To(gomega.BeEmpty())
+	errs = validateIPPool("networks[0].ipPool", &api.VSphereIPPool{Ranges: []string{"fd00::/63"}, PrefixLength: 64})
+	g.Expect(errs).To(gomega.ConsistOf(gomega.MatchError("networks[0].ipPool.ranges: IP range \"fd00::/63\" is larger than a /64 network")))
+
+	errs = validateIPPool("networks[0].ipPool", &api.VSphereIPPool{PrefixLength: 0})
+	g.Expect(errs).To(gomega.HaveLen(2))
+}
+
+func TestValidateValueSources(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	secret := &corev1.Secret{Data: map[string][]byte{
+		"vspherePassword": []byte("secret"),
+		"userData":        []byte("#cloud-config"),
+		"registryToken":   []byte("token"),
+	}}
+	values := map[string]string{"guestinfo.plain": "value"}
+
+	errs := validateValueSources("extraConfigFrom", map[string]api.VSphereValueSource{
+		"guestinfo.token": {SecretKey: "registryToken"},
+	}, values, secret)
+	g.Expect(errs).To(gomega.BeEmpty())
+
+	errs = validateValueSources("extraConfigFrom", map[string]api.VSphereValueSource{
+		"guestinfo.plain": {SecretKey: "registryToken"},
+		"guestinfo.empty": {},
+		"guestinfo.other": {SecretKey: "otherToken"},
+	}, values, secret)
+	g.Expect(errs).To(gomega.ConsistOf(
+		gomega.MatchError("extraConfigFrom[guestinfo.plain]: key is also specified with a value"),
+		gomega.MatchError("extraConfigFrom[guestinfo.empty].secretKey is required"),
+		gomega.MatchError("extraConfigFrom[guestinfo.other]: Secret otherToken not found"),
+	))
+
+	for _, key := range api.ProtectedSecretKeys {
+		errs = validateValueSources("vapp.propertiesFrom", map[string]api.VSphereValueSource{"p": {SecretKey: key}}, nil, secret)
+		g.Expect(errs).To(gomega.ConsistOf(gomega.MatchError("vapp.propertiesFrom[p]: Secret " + key + " must not be passed to the VM")))
+	}
+}
+
+func TestValidateConsoleCredentials(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	password := &corev1.Secret{Data: map[string][]byte{"consolePassword": []byte("secret")}}
+	passwordHash := &corev1.Secret{Data: map[string][]byte{"consolePasswordHash": []byte("$6$salt$hash")}}
+	spec := func(format string) *api.VsphereProviderSpec {
+		return &api.VsphereProviderSpec{Bootstrap: &api.VSphereBootstrap{Format: format}}
+	}
+
+	g.Expect(validateConsoleCredentials(&api.VsphereProviderSpec{}, passwordHash)).To(gomega.BeEmpty())
+	g.Expect(validateConsoleCredentials(spec(api.BootstrapFormatIgnition), passwordHash)).To(gomega.BeEmpty())
+	g.Expect(validateConsoleCredentials(spec(api.BootstrapFormatCloudInitVApp), password)).To(gomega.BeEmpty())
+	g.Expect(validateConsoleCredentials(spec(api.BootstrapFormatCloudInitVApp), passwordHash)).To(gomega.HaveLen(1))
+	for _, format := range []string{api.BootstrapFormatCloudInitGuestInfo, api.BootstrapFormatNoCloudISO, api.BootstrapFormatCustomization, api.BootstrapFormatRawVApp} {
+		g.Expect(validateConsoleCredentials(spec(format), password)).To(gomega.HaveLen(1), format)
+		g.Expect(validateConsoleCredentials(spec(format), &corev1.Secret{})).To(gomega.BeEmpty(), format)
+	}
+}
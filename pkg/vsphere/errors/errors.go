@@ -30,3 +30,13 @@ type MachineNotFoundError struct {
 func (e *MachineNotFoundError) Error() string {
 	return fmt.Sprintf("machine name=%s, uuid=%s not found", e.Name, e.MachineID)
 }
+
+// InvalidArgumentError is used to indicate invalid input in PluginSPI, which cannot succeed on retry
+type InvalidArgumentError struct {
+	// Message describes the invalid argument
+	Message string
+}
+
+func (e *InvalidArgumentError) Error() string {
+	return e.Message
+}
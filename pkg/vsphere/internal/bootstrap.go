@@ -0,0 +1,309 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	errors2 "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/errors"
+)
+
+// bootstrapInput is the data to be provided to the guest OS on first boot
+type bootstrapInput struct {
+	spec     *api.VsphereProviderSpec
+	hostname string
+	userData string
+	sshKeys  []string
+	guestID  string
+	nics     []guestNetworkInterface
+	console  consoleCredentials
+}
+
+// fqdn returns the fully qualified host name with the first search domain of the network interfaces, if any
+func (in *bootstrapInput) fqdn() string {
+	for _, nic := range in.spec.Networks {
+		if len(nic.SearchDomains) > 0 {
+			return in.hostname + "." + nic.SearchDomains[0]
+		}
+	}
+	return ""
+}
+
+// bootstrapData is applied to the VM on reconfiguration before powering on
+type bootstrapData struct {
+	vapp        *api.VApp
+	extraConfig map[string]string
+	// seedISO is an image to be attached as CD-ROM
+	seedISO []byte
+}
+
+const (
+	// maxVAppPropertySize is a conservative size limit for a vApp property value
+	maxVAppPropertySize = 64 * 1024
+	// maxExtraConfigValueSize is a conservative size limit for an extra config value
+	maxExtraConfigValueSize = 64 * 1024
+)
+
+// checkSize returns an InvalidArgumentError if a value exceeds the size limit of its transport.
+// vCenter rejects larger values with errors not pointing to the cause.
+func (d *bootstrapData) checkSize() error {
+	if d.vapp != nil {
+		for key, value := range d.vapp.Properties {
+			if len(value) > maxVAppPropertySize {
+				return &errors2.InvalidArgumentError{Message: fmt.Sprintf("bootstrap data of %d bytes exceeds the size limit of %d bytes for vApp property %s", len(value), maxVAppPropertySize, key)}
+			}
+		}
+	}
+	for key, value := range d.extraConfig {
+		if len(value) > maxExtraConfigValueSize {
+			return &errors2.InvalidArgumentError{Message: fmt.Sprintf("bootstrap data of %d bytes exceeds the size limit of %d bytes for extra config %s", len(value), maxExtraConfigValueSize, key)}
+		}
+	}
+	return nil
+}
+
+// bootstrapStrategy provides the user data in a format understood by the guest OS
+type bootstrapStrategy interface {
+	prepare(in *bootstrapInput) (*bootstrapData, error)
+}
+
+// customizationBootstrapStrategy is implemented by strategies passing the user data by guest customization.
+// The identity settings are applied while cloning, i.e. before the guest ID and network cards are known.
+type customizationBootstrapStrategy interface {
+	customizationIdentity(in *bootstrapInput) (types.BaseCustomizationIdentitySettings, error)
+}
+
+var bootstrapStrategies = map[string]bootstrapStrategy{}
+
+// registerBootstrapStrategy registers the strategy for the bootstrap format
+func registerBootstrapStrategy(format string, strategy bootstrapStrategy) {
+	bootstrapStrategies[format] = strategy
+}
+
+func init() {
+	registerBootstrapStrategy(api.BootstrapFormatIgnition, ignitionBootstrap{})
+	registerBootstrapStrategy(api.BootstrapFormatCloudInitVApp, cloudInitVAppBootstrap{})
+	registerBootstrapStrategy(api.BootstrapFormatCloudInitGuestInfo, cloudInitGuestInfoBootstrap{})
+	registerBootstrapStrategy(api.BootstrapFormatCustomization, customizationBootstrap{})
+	registerBootstrapStrategy(api.BootstrapFormatRawVApp, rawVAppBootstrap{})
+	registerBootstrapStrategy(api.BootstrapFormatNoCloudISO, noCloudISOBootstrap{})
+}
+
+// bootstrapFormat returns the explicit bootstrap format of the spec or guesses it from the guest ID
+func bootstrapFormat(spec *api.VsphereProviderSpec, guestID string) string {
+	if spec.Bootstrap != nil && spec.Bootstrap.Format != "" {
+		return spec.Bootstrap.Format
+	}
+	switch guestID {
+	case "coreos64Guest", "other4xLinux64Guest":
+		// other4xLinux64Guest is used as label for flatcar
+		return api.BootstrapFormatIgnition
+	default:
+		return api.BootstrapFormatCloudInitVApp
+	}
+}
+
+// bootstrapStrategyFor returns the registered strategy of the bootstrap format
+func bootstrapStrategyFor(format string) (bootstrapStrategy, error) {
+	strategy, ok := bootstrapStrategies[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported bootstrap format %q", format)
+	}
+	return strategy, nil
+}
+
+// ignitionBootstrap provides an Ignition config as vApp property
+type ignitionBootstrap struct{}
+
+func (ignitionBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	installPath := "/var/lib/flatcar-install"
+	if in.guestID == "coreos64Guest" {
+		installPath = "/var/lib/coreos-install"
+	}
+	passwordHash, err := in.console.hash()
+	if err != nil {
+		return nil, errors.Wrap(err, "hashing console password failed")
+	}
+	config := &ignitionConfig{
+		PasswdHash:    passwordHash,
+		Hostname:      in.hostname,
+		Userdata:      in.userData,
+		SSHKeys:       in.sshKeys,
+		InstallPath:   installPath,
+		NetworkdUnits: networkdUnitsFor(in.nics),
+	}
+	if in.spec.Bootstrap != nil {
+		config.Version = in.spec.Bootstrap.IgnitionVersion
+	}
+	// the config is not logged, as it contains the console password hash
+	ignitionContent, err := ignitionFile(config)
+	if err != nil {
+		return nil, err
+	}
+	return &bootstrapData{vapp: &api.VApp{Properties: map[string]string{"guestinfo.ignition.config.data": ignitionContent}}}, nil
+}
+
+// cloudInitVAppBootstrap provides cloud-init as VApp.
+// This assumes, that the image defines a VApp with the properties
+// "hostname", "user-data" and "password" like the Ubuntu cloud images
+type cloudInitVAppBootstrap struct{}
+
+func (cloudInitVAppBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	newUserdata, err := prepareUserData(in.userData, in.sshKeys, in.hostname, in.fqdn())
+	if err != nil {
+		return nil, err
+	}
+	// cloud-init detects and decompresses gzip compressed user data
+	encodedUserdata := []byte(newUserdata)
+	if compressed, err := gzipData(encodedUserdata); err != nil {
+		return nil, errors.Wrap(err, "compressing user data failed")
+	} else if len(compressed) < len(encodedUserdata) {
+		encodedUserdata = compressed
+	}
+	props := map[string]string{"hostname": in.hostname, "user-data": base64.StdEncoding.EncodeToString(encodedUserdata)}
+	if len(in.nics) > 0 {
+		// requires a template with the vApp property "network-config" (supported by the cloud-init OVF datasource)
+		networkConfig, err := cloudInitNetworkConfigV2(in.nics)
+		if err != nil {
+			return nil, errors.Wrap(err, "generating network config failed")
+		}
+		props["network-config"] = base64.StdEncoding.EncodeToString([]byte(networkConfig))
+	}
+	// For debugging proposes login on machine via vsphere web console might be helpful.
+	if in.console.password != "" {
+		props["password"] = in.console.password
+	} else if in.console.passwordHash != "" {
+		klog.Warningf("Console password hash is not supported by bootstrap format %s and ignored, use %s instead", api.BootstrapFormatCloudInitVApp, secretConsolePassword)
+	}
+	return &bootstrapData{vapp: &api.VApp{Properties: props}}, nil
+}
+
+// cloudInitGuestInfoBootstrap provides cloud-init user data and metadata as guestinfo extra config,
+// which is read by the VMware datasource of cloud-init without vApp properties in the template.
+// See https://cloudinit.readthedocs.io/en/latest/reference/datasources/vmware.html
+type cloudInitGuestInfoBootstrap struct{}
+
+func (cloudInitGuestInfoBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	in.console.warnIgnored(api.BootstrapFormatCloudInitGuestInfo)
+	newUserdata, err := prepareUserData(in.userData, in.sshKeys, in.hostname, in.fqdn())
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := cloudInitMetadata(in.hostname, in.nics)
+	if err != nil {
+		return nil, err
+	}
+	encodedUserdata, err := gzipBase64([]byte(newUserdata))
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding user data failed")
+	}
+	encodedMetadata, err := gzipBase64([]byte(metadata))
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding metadata failed")
+	}
+	return &bootstrapData{extraConfig: map[string]string{
+		"guestinfo.userdata":          encodedUserdata,
+		"guestinfo.userdata.encoding": encodingGzipBase64,
+		"guestinfo.metadata":          encodedMetadata,
+		"guestinfo.metadata.encoding": encodingGzipBase64,
+	}}, nil
+}
+
+// customizationBootstrap passes cloud-init user data and metadata by guest customization (requires vSphere 7.0 U3).
+type customizationBootstrap struct{}
+
+func (customizationBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	in.console.warnIgnored(api.BootstrapFormatCustomization)
+	// already provided while cloning
+	return &bootstrapData{}, nil
+}
+
+func (customizationBootstrap) customizationIdentity(in *bootstrapInput) (types.BaseCustomizationIdentitySettings, error) {
+	newUserdata, err := prepareUserData(in.userData, in.sshKeys, in.hostname, in.fqdn())
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := cloudInitMetadata(in.hostname, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &types.CustomizationCloudinitPrep{Metadata: metadata, Userdata: newUserdata}, nil
+}
+
+// rawVAppBootstrap provides the user data unmodified as base64 encoded vApp property "user-data",
+// for images processing the user data on their own.
+type rawVAppBootstrap struct{}
+
+func (rawVAppBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	in.console.warnIgnored(api.BootstrapFormatRawVApp)
+	props := map[string]string{"user-data": base64.StdEncoding.EncodeToString([]byte(in.userData))}
+	return &bootstrapData{vapp: &api.VApp{Properties: props}}, nil
+}
+
+// encodingGzipBase64 is the encoding of gzip compressed and base64 encoded guestinfo values
+const encodingGzipBase64 = "gzip+base64"
+
+// cloudInitMetadata returns the cloud-init instance metadata.
+// The network config of static network interfaces is embedded gzip compressed and base64 encoded.
+func cloudInitMetadata(hostname string, nics []guestNetworkInterface) (string, error) {
+	metadata := map[string]string{"instance-id": hostname, "local-hostname": hostname}
+	if len(nics) > 0 {
+		networkConfig, err := cloudInitNetworkConfigV2(nics)
+		if err != nil {
+			return "", errors.Wrap(err, "generating network config failed")
+		}
+		if metadata["network"], err = gzipBase64([]byte(networkConfig)); err != nil {
+			return "", errors.Wrap(err, "encoding network config failed")
+		}
+		metadata["network.encoding"] = encodingGzipBase64
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return "", errors.Wrap(err, "generating metadata failed")
+	}
+	return string(content), nil
+}
+
+// gzipBase64 compresses the data with gzip and encodes it with base64
+func gzipBase64(data []byte) (string, error) {
+	compressed, err := gzipData(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(compressed), nil
+}
+
+// gzipData compresses the data with gzip
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
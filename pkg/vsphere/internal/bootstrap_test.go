@@ -0,0 +1,155 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/pkg/errors"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	errors2 "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/errors"
+)
+
+func TestBootstrapFormat(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &api.VsphereProviderSpec{}
+	g.Expect(bootstrapFormat(spec, "coreos64Guest")).To(gomega.Equal(api.BootstrapFormatIgnition))
+	g.Expect(bootstrapFormat(spec, "other4xLinux64Guest")).To(gomega.Equal(api.BootstrapFormatIgnition))
+	g.Expect(bootstrapFormat(spec, "ubuntu64Guest")).To(gomega.Equal(api.BootstrapFormatCloudInitVApp))
+
+	spec.Bootstrap = &api.VSphereBootstrap{Format: api.BootstrapFormatCloudInitGuestInfo}
+	g.Expect(bootstrapFormat(spec, "coreos64Guest")).To(gomega.Equal(api.BootstrapFormatCloudInitGuestInfo))
+
+	for _, format := range api.SupportedBootstrapFormats {
+		_, err := bootstrapStrategyFor(format)
+		g.Expect(err).NotTo(gomega.HaveOccurred(), format)
+	}
+	_, err := bootstrapStrategyFor("unknown")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestCloudInitGuestInfoBootstrap(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	data, err := cloudInitGuestInfoBootstrap{}.prepare(&bootstrapInput{
+		spec:     &api.VsphereProviderSpec{},
+		hostname: "foo",
+		userData: "#cloud-config\n",
+		nics:     []guestNetworkInterface{{MACAddress: "00:50:56:00:00:01", IPAddresses: []string{"10.0.0.10/24"}}},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data.vapp).To(gomega.BeNil())
+	g.Expect(data.extraConfig).To(gomega.HaveKeyWithValue("guestinfo.userdata.encoding", "gzip+base64"))
+	g.Expect(data.extraConfig).To(gomega.HaveKeyWithValue("guestinfo.metadata.encoding", "gzip+base64"))
+	g.Expect(gunzipBase64(t, data.extraConfig["guestinfo.userdata"])).To(gomega.Equal("#cloud-config\nhostname: foo\n"))
+
+	var metadata map[string]string
+	g.Expect(json.Unmarshal([]byte(gunzipBase64(t, data.extraConfig["guestinfo.metadata"])), &metadata)).To(gomega.Succeed())
+	g.Expect(metadata).To(gomega.HaveKeyWithValue("instance-id", "foo"))
+	g.Expect(metadata).To(gomega.HaveKeyWithValue("local-hostname", "foo"))
+	g.Expect(metadata).To(gomega.HaveKeyWithValue("network.encoding", "gzip+base64"))
+	g.Expect(gunzipBase64(t, metadata["network"])).To(gomega.ContainSubstring("10.0.0.10/24"))
+}
+
+func gunzipBase64(t *testing.T, value string) string {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestRawVAppBootstrap(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	data, err := rawVAppBootstrap{}.prepare(&bootstrapInput{
+		spec:     &api.VsphereProviderSpec{},
+		hostname: "foo",
+		userData: "#cloud-config\n",
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	// templates only need to declare the user-data property
+	g.Expect(data.vapp.Properties).To(gomega.Equal(map[string]string{"user-data": base64.StdEncoding.EncodeToString([]byte("#cloud-config\n"))}))
+	g.Expect(data.extraConfig).To(gomega.BeEmpty())
+}
+
+func TestNoCloudISOBootstrap(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	data, err := noCloudISOBootstrap{}.prepare(&bootstrapInput{
+		spec:     &api.VsphereProviderSpec{},
+		hostname: "foo",
+		userData: "#cloud-config\n",
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data.vapp).To(gomega.BeNil())
+	g.Expect(data.seedISO).NotTo(gomega.BeEmpty())
+	g.Expect(bytes.Contains(data.seedISO, []byte(`{"instance-id":"foo","local-hostname":"foo"}`))).To(gomega.BeTrue())
+}
+
+func TestBootstrapDataCheckSize(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	data := &bootstrapData{
+		vapp:        &api.VApp{Properties: map[string]string{"user-data": "abc"}},
+		extraConfig: map[string]string{"guestinfo.userdata": "abc"},
+	}
+	g.Expect(data.checkSize()).To(gomega.Succeed())
+
+	data.extraConfig["guestinfo.userdata"] = strings.Repeat("a", maxExtraConfigValueSize+1)
+	err := data.checkSize()
+	g.Expect(err).To(gomega.BeAssignableToTypeOf(&errors2.InvalidArgumentError{}))
+}
+
+func TestPrepareBootstrap(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &api.VsphereProviderSpec{
+		Bootstrap: &api.VSphereBootstrap{Format: api.BootstrapFormatCloudInitGuestInfo},
+		Networks:  []api.VSphereNetworkInterface{{Name: "net1", IPAddresses: []string{"10.0.0.10/24"}}},
+	}
+	nics := placeholderGuestNetworkInterfaces(spec)
+	g.Expect(nics).To(gomega.HaveLen(1))
+	g.Expect(nics[0].MACAddress).To(gomega.HaveLen(len("00:50:56:00:00:01")))
+
+	cmd := newClone("machine1", spec, "#cloud-config\n")
+	data, err := cmd.prepareBootstrap("ubuntu64Guest", nics)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data.extraConfig).To(gomega.HaveKey("guestinfo.metadata"))
+
+	// raw user data is not compressed
+	spec.Bootstrap.Format = api.BootstrapFormatRawVApp
+	cmd = newClone("machine1", spec, strings.Repeat("a", maxVAppPropertySize+1))
+	_, err = cmd.prepareBootstrap("ubuntu64Guest", nics)
+	g.Expect(errors.Cause(err)).To(gomega.BeAssignableToTypeOf(&errors2.InvalidArgumentError{}))
+}
@@ -18,21 +18,26 @@ package internal
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
-	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/contentlibrary"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/templating"
+	errors2 "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/errors"
 	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
 	"github.com/pkg/errors"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog/v2"
@@ -43,17 +48,35 @@ const (
 
 	envPassword     = "VMWARE_MACHINE_PASSWORD"
 	envPasswordHash = "VMWARE_MACHINE_PASSWORD_HASH"
-	hwVersion       = 15 // recommended in https://cloud-provider-vsphere.sigs.k8s.io/tutorials/kubernetes-on-vsphere-with-kubeadm.html
+	// recommended in https://cloud-provider-vsphere.sigs.k8s.io/tutorials/kubernetes-on-vsphere-with-kubeadm.html
+	defaultHardwareVersion = "vmx-15"
+
+	defaultAdapterType = "vmxnet3"
 )
 
 type clone struct {
-	name     string
-	userData string
-	spec     *api.VsphereProviderSpec
+	name         string
+	userData     string
+	console      consoleCredentials
+	spec         *api.VsphereProviderSpec
+	ipAllocation string
+	profileID    string
+
+	// vapp and extraConfig of the spec with rendered templates and values from the secret
+	vapp        *api.VApp
+	extraConfig map[string]string
+	secretData  map[string][]byte
+
+	// nicCards are the network cards of the network interfaces as configured for the clone
+	nicCards []types.BaseVirtualDevice
 
-	NetworkFlag *flags.NetworkFlag
+	pbmClient         *pbm.Client
+	storageProfileIDs map[string]string
+
+	NetworkFlags []*flags.NetworkFlag
 
 	Client         *vim25.Client
+	RestClient     *rest.Client
 	Cluster        *object.ClusterComputeResource
 	Datacenter     *object.Datacenter
 	Datastore      *object.Datastore
@@ -62,6 +85,7 @@ type clone struct {
 	HostSystem     *object.HostSystem
 	Folder         *object.Folder
 	VirtualMachine *object.VirtualMachine
+	LibraryItem    *contentlibrary.Item
 
 	Clone *object.VirtualMachine
 }
@@ -75,6 +99,10 @@ func (cmd *clone) Run(ctx context.Context, client *govmomi.Client) error {
 
 	ctx = flags.ContextWithPseudoFlagset(ctx, client, cmd.spec)
 
+	if err = cmd.renderTemplates(); err != nil {
+		return errors.Wrap(err, "rendering templates failed")
+	}
+
 	clientFlag, ctx := flags.NewClientFlag(ctx)
 	cmd.Client, err = clientFlag.Client()
 	if err != nil {
@@ -99,7 +127,7 @@ func (cmd *clone) Run(ctx context.Context, client *govmomi.Client) error {
 		if err != nil {
 			return errors.Wrap(err, "preparing StoragePodFlag failed")
 		}
-	} else if cmd.Cluster == nil {
+	} else if cmd.Cluster == nil && !cmd.usesStoragePolicyPlacement() {
 		datastoreFlag, ctx2 := flags.NewDatastoreFlag(ctx)
 		ctx = ctx2
 		cmd.Datastore, err = datastoreFlag.Datastore()
@@ -138,107 +166,118 @@ func (cmd *clone) Run(ctx context.Context, client *govmomi.Client) error {
 		return errors.Wrap(err, "preparing FolderFlag failed")
 	}
 
-	cmd.NetworkFlag, ctx = flags.NewNetworkFlag(ctx)
+	if cmd.spec.StoragePolicy != "" {
+		if cmd.profileID, err = cmd.storageProfileID(ctx, cmd.spec.StoragePolicy); err != nil {
+			return errors.Wrap(err, "preparing storage policy failed")
+		}
+	}
 
-	virtualMachineFlag, ctx := flags.NewVirtualMachineFlag(ctx)
-	if cmd.VirtualMachine, err = virtualMachineFlag.VirtualMachine(); err != nil {
-		return errors.Wrap(err, "preparing VirtualMachineFlag failed")
+	if len(cmd.spec.Networks) > 0 {
+		for _, nic := range cmd.spec.Networks {
+			var networkFlag *flags.NetworkFlag
+			networkFlag, ctx = flags.NewCustomNetworkFlag(ctx, nic.Name, nic.SwitchUUID, nic.AdapterType)
+			cmd.NetworkFlags = append(cmd.NetworkFlags, networkFlag)
+		}
+	} else {
+		networkFlag, ctx2 := flags.NewNetworkFlag(ctx)
+		ctx = ctx2
+		if networkFlag.IsSet() {
+			cmd.NetworkFlags = append(cmd.NetworkFlags, networkFlag)
+		}
 	}
 
-	if cmd.VirtualMachine == nil {
-		return fmt.Errorf("template vm not set")
+	if cmd.LibraryItem, err = contentlibrary.ParseTemplate(cmd.spec.TemplateVM); err != nil {
+		return errors.Wrap(err, "parsing templateVM failed")
 	}
+	if cmd.LibraryItem == nil {
+		virtualMachineFlag, ctx2 := flags.NewVirtualMachineFlag(ctx)
+		ctx = ctx2
+		if cmd.VirtualMachine, err = virtualMachineFlag.VirtualMachine(); err != nil {
+			return errors.Wrap(err, "preparing VirtualMachineFlag failed")
+		}
 
-	vm, err := cmd.cloneVM(ctx, cmd.spec.SystemDisk)
-	if err != nil {
-		return errors.Wrap(err, "cloning template VM failed")
+		if cmd.VirtualMachine == nil {
+			return fmt.Errorf("template vm not set")
+		}
 	}
-	cmd.Clone = vm
 
-	var props mo.VirtualMachine
-	if err := cmd.VirtualMachine.Properties(ctx, cmd.VirtualMachine.Reference(), nil, &props); err != nil {
-		return errors.Wrap(err, "retrieving properties from template VM failed")
+	if hasIPPools(cmd.spec) {
+		if cmd.ipAllocation, err = defaultIPAllocator.allocate(ctx, client, cmd.spec, cmd.name); err != nil {
+			return errors.Wrap(err, "allocating IP addresses failed")
+		}
+		// the allocation is pending until it is recorded on the VM or the creation failed
+		defer defaultIPAllocator.release(cmd.name)
 	}
-	guestID := props.Config.GuestId
-	if cmd.spec.GuestID != "" {
-		guestID = cmd.spec.GuestID
+
+	// check the bootstrap data before creating the VM, the MAC addresses are only known afterwards.
+	// A deployed library item has the guest id of its template.
+	guestID := cmd.spec.GuestID
+	if guestID == "" && cmd.VirtualMachine != nil {
+		if guestID, err = templateGuestID(ctx, cmd.VirtualMachine); err != nil {
+			return err
+		}
+	}
+	if guestID != "" {
+		if _, err = cmd.prepareBootstrap(guestID, placeholderGuestNetworkInterfaces(cmd.spec)); err != nil {
+			return err
+		}
 	}
-	klog.V(4).Infof("Template guestId: %s, used guestId: %s", props.Config.GuestId, guestID)
 
-	sshkeys := make([]string, len(cmd.spec.SSHKeys))
-	for i := range cmd.spec.SSHKeys {
-		sshkeys[i] = strings.TrimSpace(cmd.spec.SSHKeys[i])
+	var vm *object.VirtualMachine
+	if cmd.LibraryItem != nil {
+		if vm, err = cmd.deployLibraryItem(ctx); err != nil {
+			return errors.Wrap(err, "deploying library item failed")
+		}
+	} else {
+		if vm, err = cmd.cloneVM(ctx, cmd.spec.SystemDisk); err != nil {
+			return errors.Wrap(err, "cloning template VM failed")
+		}
 	}
-	vapp := cmd.spec.VApp
-	if vapp == nil {
+	cmd.Clone = vm
 
-		switch guestID {
-		case "coreos64Guest":
-			// provide ignition as VApp
-			config := &ignitionConfig{
-				PasswdHash:     "*",
-				Hostname:       cmd.name,
-				UserdataBase64: base64.StdEncoding.EncodeToString([]byte(cmd.userData)),
-				SSHKeys:        sshkeys,
-				InstallPath:    "/var/lib/coreos-install",
-			}
-			// Login to machine happens normally via ssh and provided ssh keys
-			// For debugging proposes login on machine via vsphere web console might be helpful.
-			// In this case, the password hash can be set as environmental variable for the machine controller.
-			// e.g. use `openssl passwd -1` to generate the hash
-			passwordHash := os.Getenv(envPasswordHash)
-			if passwordHash != "" {
-				config.PasswdHash = passwordHash
-			}
-			ignitionContent, err := ignitionFile(config)
-			klog.V(4).Infof("ignitionContent: |%s|", ignitionContent)
-			if err != nil {
-				return errors.Wrap(err, "setting VApp (coreos64)")
-			}
-			vapp = &api.VApp{Properties: map[string]string{"guestinfo.ignition.config.data": ignitionContent}}
-		case "other4xLinux64Guest":
-			// experimental support for flatcar
-			// other4xLinux64Guest is used as label for flatcar
-			// provide ignition as VApp
-			config := &ignitionConfig{
-				PasswdHash:     "*",
-				Hostname:       cmd.name,
-				UserdataBase64: base64.StdEncoding.EncodeToString([]byte(cmd.userData)),
-				SSHKeys:        sshkeys,
-				InstallPath:    "/var/lib/flatcar-install",
-			}
-			// Login to machine happens normally via ssh and provided ssh keys
-			// For debugging proposes login on machine via vsphere web console might be helpful.
-			// In this case, the password hash can be set as environmental variable for the machine controller.
-			// e.g. use `openssl passwd -1` to generate the hash
-			passwordHash := os.Getenv(envPasswordHash)
-			if passwordHash != "" {
-				config.PasswdHash = passwordHash
-			}
-			ignitionContent, err := ignitionFile(config)
-			klog.V(4).Infof("ignitionContent: |%s|", ignitionContent)
+	if cmd.ipAllocation != "" {
+		record := func() error {
+			manager, err := object.GetCustomFieldsManager(client.Client)
 			if err != nil {
-				return errors.Wrap(err, "setting VApp (flatcar64)")
+				return errors.Wrap(err, "GetCustomFieldsManager failed")
 			}
-			vapp = &api.VApp{Properties: map[string]string{"guestinfo.ignition.config.data": ignitionContent}}
-		default:
-			// Provide cloud-init as VApp.
-			// This assumes, that the image defines a VApp with the properties
-			// "hostname", "user-data" and "password" like the Ubuntu cloud images
-			newUserdata, err := prepareUserData(cmd.userData, sshkeys)
-			if err != nil {
-				return errors.Wrap(err, "setting VApp (default)")
-			}
-			props := map[string]string{"hostname": cmd.name, "user-data": base64.StdEncoding.EncodeToString([]byte(newUserdata))}
-			// Login to machine happens normally via ssh and provided ssh keys
-			// For debugging proposes login on machine via vsphere web console might be helpful.
-			// In this case, the password can be set as environmental variable for the machine controller.
-			password := os.Getenv(envPassword)
-			if password != "" {
-				props["password"] = password
-			}
-			vapp = &api.VApp{Properties: props}
+			return setCustomValue(ctx, manager, vm.Reference(), ipAllocationAttribute, cmd.ipAllocation)
+		}
+		if err = recordIPAllocation(cmd.name, record, func() error { return destroyVM(ctx, vm) }); err != nil {
+			return err
+		}
+	}
+
+	if guestID == "" {
+		if guestID, err = templateGuestID(ctx, vm); err != nil {
+			return err
+		}
+	}
+	klog.V(4).Infof("Used guestId: %s", guestID)
+
+	var nics []guestNetworkInterface
+	if hasStaticNetworking(cmd.spec) {
+		devices, err := vm.Device(ctx)
+		if err != nil {
+			return errors.Wrap(err, "listing VM devices failed")
+		}
+		if nics, err = newGuestNetworkInterfaces(cmd.spec, devices, cmd.nicCards); err != nil {
+			return errors.Wrap(err, "preparing guest network config failed")
+		}
+	}
+
+	bootstrap, err := cmd.prepareBootstrap(guestID, nics)
+	if err != nil {
+		// do not leave a VM behind which is never bootstrapped, a retry would fail in the same way
+		if destroyErr := destroyVM(ctx, vm); destroyErr != nil {
+			klog.Errorf("Destroying VM %s after failed bootstrap preparation failed: %s", cmd.name, destroyErr)
 		}
+		return err
+	}
+
+	vapp := cmd.vapp
+	if vapp == nil {
+		vapp = bootstrap.vapp
 	}
 
 	vappConfig, err := cmd.expandVAppConfig(vapp)
@@ -246,33 +285,57 @@ func (cmd *clone) Run(ctx context.Context, client *govmomi.Client) error {
 		return errors.Wrap(err, "expanding VApp failed")
 	}
 
-	vmConfigSpec := types.VirtualMachineConfigSpec{}
-	cpus := cmd.spec.NumCpus
-	if cpus > 0 {
-		vmConfigSpec.NumCPUs = int32(cpus)
+	vmConfigSpec := hardwareConfigSpec(cmd.spec)
+	if cmd.spec.LinkedClone && cmd.spec.SystemDisk != nil {
+		// extend the child disk of the linked clone
+		devices, err := vm.Device(ctx)
+		if err != nil {
+			return errors.Wrap(err, "listing VM devices failed")
+		}
+		diskSpec, err := systemDiskDeviceChange(devices, cmd.spec.SystemDisk)
+		if err != nil {
+			return err
+		}
+		vmConfigSpec.DeviceChange = append(vmConfigSpec.DeviceChange, diskSpec)
 	}
-	memory := cmd.spec.Memory
-	if memory > 0 {
-		vmConfigSpec.MemoryMB = int64(memory)
+	if bootstrap.seedISO != nil {
+		deviceChanges, err := cmd.attachSeedISO(ctx, vm, bootstrap.seedISO)
+		if err != nil {
+			return errors.Wrap(err, "attaching seed ISO image failed")
+		}
+		vmConfigSpec.DeviceChange = append(vmConfigSpec.DeviceChange, deviceChanges...)
 	}
-	vmConfigSpec.MemoryReservationLockedToMax = cmd.spec.MemoryReservationLockedToMax
 	vmConfigSpec.VAppConfig = vappConfig
-	if cmd.spec.GuestID != "" {
-		vmConfigSpec.GuestId = cmd.spec.GuestID
-	}
 
-	// ensure that Disk UUID is enabled
-	btrue := true
-	vmConfigSpec.Flags = &types.VirtualMachineFlagInfo{DiskUuidEnabled: &btrue}
+	identity, err := cmd.machineIdentity(ctx, vm)
+	if err != nil {
+		return errors.Wrap(err, "collecting machine identity failed")
+	}
 
-	// optional extra config
-	if len(cmd.spec.ExtraConfig) > 0 {
+	// optional extra config, explicit values take precedence over the NUMA settings and bootstrap data,
+	// the machine identity cannot be overridden
+	extraConfig := numaExtraConfig(cmd.spec.NUMA)
+	for k, v := range bootstrap.extraConfig {
+		extraConfig[k] = v
+	}
+	for k, v := range cmd.extraConfig {
+		extraConfig[k] = v
+	}
+	for k, v := range identity.extraConfig() {
+		extraConfig[k] = v
+	}
+	if len(extraConfig) > 0 {
 		vmConfigSpec.ExtraConfig = []types.BaseOptionValue{}
-		for k, v := range cmd.spec.ExtraConfig {
+		for k, v := range extraConfig {
 			vmConfigSpec.ExtraConfig = append(vmConfigSpec.ExtraConfig, &types.OptionValue{Key: k, Value: v})
 		}
 	}
 
+	// upgrade first, as the reconfiguration may depend on features of the hardware version
+	if err = cmd.upgradeHardware(ctx, vm); err != nil {
+		return errors.Wrap(err, "upgrading hardware version failed")
+	}
+
 	task, err := vm.Reconfigure(ctx, vmConfigSpec)
 	if err != nil {
 		return errors.Wrap(err, "starting reconfiguring VM failed")
@@ -282,56 +345,256 @@ func (cmd *clone) Run(ctx context.Context, client *govmomi.Client) error {
 		return errors.Wrap(err, "reconfiguring VM failed")
 	}
 
-	if len(cmd.spec.Tags) > 0 {
+	if len(cmd.spec.Tags) > 0 && usesCustomAttributes(cmd.spec) {
 		manager, err := object.GetCustomFieldsManager(client.Client)
 		if err != nil {
 			return errors.Wrap(err, "Set tags: GetCustomFieldsManager failed")
 		}
 
 		for k, v := range cmd.spec.Tags {
-			key, err := manager.FindKey(ctx, k)
-			if err != nil {
-				if err != object.ErrKeyNameNotFound {
-					return errors.Wrapf(err, "Set tags: FindKey failed for %s", k)
-				}
-				fieldDef, err := manager.Add(ctx, k, "VirtualMachine", nil, nil)
-				if err != nil {
-					return errors.Wrapf(err, "Set tags: Add key %s failed", k)
-				}
-				key = fieldDef.Key
-			}
-			err = manager.Set(ctx, vm.Reference(), key, v)
-			if err != nil {
-				return errors.Wrapf(err, "Set tag %s(%d) failed", k, key)
+			if err = setCustomValue(ctx, manager, vm.Reference(), k, v); err != nil {
+				return errors.Wrap(err, "Set tags")
 			}
 		}
 	}
+	if len(cmd.spec.Tags) > 0 && usesVSphereTags(cmd.spec) {
+		if cmd.RestClient == nil {
+			return fmt.Errorf("Set vSphere tags: missing vAPI client")
+		}
+		if err = attachVSphereTags(ctx, cmd.RestClient, vm, cmd.spec.Tags); err != nil {
+			return errors.Wrap(err, "Set vSphere tags")
+		}
+	}
 
-	cmd.upgradeHardware(ctx, vm, hwVersion)
+	if cmd.spec.AntiAffinity != nil && cmd.Cluster != nil {
+		if err = addToAntiAffinityRule(ctx, client, cmd.spec, cmd.Cluster, vm.Reference()); err != nil {
+			return errors.Wrap(err, "adding VM to anti-affinity rule failed")
+		}
+	}
+	if cmd.spec.HostGroupAffinity != nil && cmd.Cluster != nil {
+		if err = addToVMGroup(ctx, cmd.spec.HostGroupAffinity, cmd.Cluster, vm.Reference()); err != nil {
+			return errors.Wrap(err, "adding VM to VM group failed")
+		}
+	}
 
 	return cmd.powerOn(ctx)
 }
 
-func (cmd *clone) upgradeHardware(ctx context.Context, vm *object.VirtualMachine, version int) error {
-	if version > 0 {
-		// update hardware
-		version := fmt.Sprintf("vmx-%02d", hwVersion)
-		task, err := vm.UpgradeVM(ctx, version)
-		if err != nil {
-			return err
+// prepareBootstrap prepares the bootstrap data for the bootstrap format of the guest id and checks its size
+func (cmd *clone) prepareBootstrap(guestID string, nics []guestNetworkInterface) (*bootstrapData, error) {
+	format := bootstrapFormat(cmd.spec, guestID)
+	strategy, err := bootstrapStrategyFor(format)
+	if err != nil {
+		return nil, err
+	}
+
+	sshkeys := make([]string, len(cmd.spec.SSHKeys))
+	for i := range cmd.spec.SSHKeys {
+		sshkeys[i] = strings.TrimSpace(cmd.spec.SSHKeys[i])
+	}
+	bootstrap, err := strategy.prepare(&bootstrapInput{
+		spec:     cmd.spec,
+		hostname: cmd.name,
+		userData: cmd.userData,
+		sshKeys:  sshkeys,
+		guestID:  guestID,
+		nics:     nics,
+		console:  cmd.console,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "preparing bootstrap data (%s) failed", format)
+	}
+	if err = bootstrap.checkSize(); err != nil {
+		return nil, errors.Wrapf(err, "preparing bootstrap data (%s) failed", format)
+	}
+	return bootstrap, nil
+}
+
+// templateGuestID returns the guest id configured on the VM
+func templateGuestID(ctx context.Context, vm *object.VirtualMachine) (string, error) {
+	var props mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.guestId"}, &props); err != nil {
+		return "", errors.Wrap(err, "retrieving properties from template VM failed")
+	}
+	return props.Config.GuestId, nil
+}
+
+// hardwareConfigSpec returns the hardware, resource and boot settings of the spec for reconfiguring the clone
+func hardwareConfigSpec(spec *api.VsphereProviderSpec) types.VirtualMachineConfigSpec {
+	vmConfigSpec := types.VirtualMachineConfigSpec{}
+	cpus := spec.NumCpus
+	if cpus > 0 {
+		vmConfigSpec.NumCPUs = int32(cpus)
+	}
+	memory := spec.Memory
+	if memory > 0 {
+		vmConfigSpec.MemoryMB = int64(memory)
+	}
+	vmConfigSpec.MemoryReservationLockedToMax = spec.MemoryReservationLockedToMax
+	vmConfigSpec.CpuAllocation = resourceAllocation(spec.CPUAllocation)
+	vmConfigSpec.MemoryAllocation = resourceAllocation(spec.MemoryAllocation)
+	if spec.CoresPerSocket > 0 {
+		vmConfigSpec.NumCoresPerSocket = int32(spec.CoresPerSocket)
+	}
+	vmConfigSpec.CpuHotAddEnabled = spec.CPUHotAddEnabled
+	vmConfigSpec.MemoryHotAddEnabled = spec.MemoryHotAddEnabled
+	if spec.LatencySensitivity != "" {
+		vmConfigSpec.LatencySensitivity = &types.LatencySensitivity{Level: types.LatencySensitivitySensitivityLevel(spec.LatencySensitivity)}
+	}
+	if spec.GuestID != "" {
+		vmConfigSpec.GuestId = spec.GuestID
+	}
+
+	vmConfigSpec.Firmware = spec.Firmware
+	if spec.SecureBoot != nil {
+		vmConfigSpec.BootOptions = &types.VirtualMachineBootOptions{EfiSecureBootEnabled: spec.SecureBoot}
+	}
+	vmConfigSpec.NestedHVEnabled = spec.NestedHV
+
+	// ensure that Disk UUID is enabled
+	btrue := true
+	vmConfigSpec.Flags = &types.VirtualMachineFlagInfo{DiskUuidEnabled: &btrue}
+	if spec.VBS != nil {
+		vmConfigSpec.Flags.VbsEnabled = spec.VBS
+		if *spec.VBS {
+			// virtualization-based security needs nested hardware virtualization and IOMMU
+			vmConfigSpec.NestedHVEnabled = &btrue
+			vmConfigSpec.Flags.VvtdEnabled = &btrue
 		}
-		err = task.Wait(ctx)
+	}
+	return vmConfigSpec
+}
+
+// resourceAllocation converts the resource allocation of the spec, unset values are kept unchanged
+func resourceAllocation(allocation *api.VSphereResourceAllocation) *types.ResourceAllocationInfo {
+	if allocation == nil {
+		return nil
+	}
+	info := &types.ResourceAllocationInfo{
+		Reservation: allocation.Reservation,
+		Limit:       allocation.Limit,
+	}
+	if allocation.Shares != "" {
+		info.Shares = &types.SharesInfo{
+			Level:  types.SharesLevel(allocation.Shares),
+			Shares: allocation.CustomShares,
+		}
+	}
+	return info
+}
+
+// numaExtraConfig returns the extra config keys of the virtual NUMA settings
+func numaExtraConfig(numa *api.VSphereNUMA) map[string]string {
+	extraConfig := map[string]string{}
+	if numa == nil {
+		return extraConfig
+	}
+	if numa.MaxVCPUsPerNode > 0 {
+		extraConfig["numa.vcpu.maxPerVirtualNode"] = strconv.Itoa(numa.MaxVCPUsPerNode)
+	}
+	if numa.MinVCPUs > 0 {
+		extraConfig["numa.vcpu.min"] = strconv.Itoa(numa.MinVCPUs)
+	}
+	if numa.FollowCoresPerSocket != nil {
+		extraConfig["numa.vcpu.followcorespersocket"] = strings.ToUpper(strconv.FormatBool(*numa.FollowCoresPerSocket))
+	}
+	return extraConfig
+}
+
+// upgradeHardware upgrades the hardware version of the VM as specified.
+// VMs which already have the same or a higher version are not changed.
+func (cmd *clone) upgradeHardware(ctx context.Context, vm *object.VirtualMachine) error {
+	var props mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.version", "environmentBrowser", "runtime.host"}, &props); err != nil {
+		return errors.Wrap(err, "retrieving hardware version failed")
+	}
+
+	var version string
+	switch cmd.spec.HardwareVersion {
+	case api.HardwareVersionKeep:
+		return nil
+	case api.HardwareVersionLatest:
+		req := types.QueryConfigOptionDescriptor{This: props.EnvironmentBrowser}
+		res, err := methods.QueryConfigOptionDescriptor(ctx, cmd.Client, &req)
 		if err != nil {
-			if isAlreadyUpgraded(err) {
-				klog.V(4).Infof("Already upgraded: %s", err)
-			} else {
-				return err
-			}
+			return errors.Wrap(err, "querying supported hardware versions failed")
+		}
+		if version = latestHardwareVersion(res.Returnval, props.Runtime.Host); version == "" {
+			return fmt.Errorf("no supported hardware version found")
+		}
+	case "":
+		version = defaultHardwareVersion
+	default:
+		version = cmd.spec.HardwareVersion
+	}
+
+	current, err := parseHardwareVersion(props.Config.Version)
+	if err != nil {
+		return err
+	}
+	target, err := parseHardwareVersion(version)
+	if err != nil {
+		return err
+	}
+	if current >= target {
+		klog.V(4).Infof("Hardware version %s is not upgraded to %s", props.Config.Version, version)
+		return nil
+	}
+
+	task, err := vm.UpgradeVM(ctx, version)
+	if err != nil {
+		return err
+	}
+	err = task.Wait(ctx)
+	if err != nil {
+		if isAlreadyUpgraded(err) {
+			klog.V(4).Infof("Already upgraded: %s", err)
+		} else {
+			return err
 		}
 	}
 	return nil
 }
 
+// latestHardwareVersion returns the highest hardware version the host can run.
+// If the host is unknown, the descriptors of all hosts are considered.
+func latestHardwareVersion(descriptors []types.VirtualMachineConfigOptionDescriptor, host *types.ManagedObjectReference) string {
+	latest, latestKey := 0, ""
+	for _, descriptor := range descriptors {
+		if descriptor.RunSupported != nil && !*descriptor.RunSupported {
+			continue
+		}
+		if host != nil && len(descriptor.Host) > 0 && !containsReference(descriptor.Host, *host) {
+			continue
+		}
+		if version, err := parseHardwareVersion(descriptor.Key); err == nil && version > latest {
+			latest, latestKey = version, descriptor.Key
+		}
+	}
+	return latestKey
+}
+
+func containsReference(refs []types.ManagedObjectReference, ref types.ManagedObjectReference) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHardwareVersion returns the number of a hardware version of the form `vmx-NN`
+func parseHardwareVersion(version string) (int, error) {
+	if !strings.HasPrefix(version, "vmx-") {
+		return 0, fmt.Errorf("invalid hardware version %q", version)
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "vmx-"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid hardware version %q", version)
+	}
+	return n, nil
+}
+
 func isAlreadyUpgraded(err error) bool {
 	if fault, ok := err.(task.Error); ok {
 		_, ok = fault.Fault().(*types.AlreadyUpgraded)
@@ -341,6 +604,58 @@ func isAlreadyUpgraded(err error) bool {
 	return false
 }
 
+// renderTemplates renders the per-machine variables into the vApp properties, the extra config values and
+// optionally the user data. Values from the secret are added unchanged.
+func (cmd *clone) renderTemplates() error {
+	vars := templating.VariablesFor(cmd.name, cmd.spec)
+	if cmd.spec.VApp != nil {
+		properties, err := templating.RenderMap(cmd.spec.VApp.Properties, vars)
+		if err != nil {
+			return errors.Wrap(err, "vapp.properties")
+		}
+		if properties, err = cmd.addSecretValues(properties, cmd.spec.VApp.PropertiesFrom); err != nil {
+			return errors.Wrap(err, "vapp.propertiesFrom")
+		}
+		cmd.vapp = &api.VApp{Properties: properties}
+	}
+	extraConfig, err := templating.RenderMap(cmd.spec.ExtraConfig, vars)
+	if err != nil {
+		return errors.Wrap(err, "extraConfig")
+	}
+	if cmd.extraConfig, err = cmd.addSecretValues(extraConfig, cmd.spec.ExtraConfigFrom); err != nil {
+		return errors.Wrap(err, "extraConfigFrom")
+	}
+	if cmd.spec.Bootstrap != nil && cmd.spec.Bootstrap.TemplateUserData {
+		if cmd.userData, err = templating.Render(cmd.userData, vars); err != nil {
+			return errors.Wrap(err, "userData")
+		}
+	}
+	return nil
+}
+
+// addSecretValues adds the values referenced by the sources from the secret.
+// The values are never logged, as they may be credentials.
+func (cmd *clone) addSecretValues(values map[string]string, sources map[string]api.VSphereValueSource) (map[string]string, error) {
+	if len(sources) == 0 {
+		return values, nil
+	}
+	if values == nil {
+		values = map[string]string{}
+	}
+	for key, source := range sources {
+		if api.IsProtectedSecretKey(source.SecretKey) {
+			return nil, fmt.Errorf("%s: secret key %s must not be passed to the VM", key, source.SecretKey)
+		}
+		value, ok := cmd.secretData[source.SecretKey]
+		if !ok {
+			return nil, fmt.Errorf("%s: secret key %s not found", key, source.SecretKey)
+		}
+		values[key] = string(value)
+	}
+	klog.V(4).Infof("Values of %d keys taken from secret", len(sources))
+	return values, nil
+}
+
 // expandVAppConfig reads in all the vapp key/value pairs and returns
 // the appropriate VmConfigSpec.
 //
@@ -445,31 +760,12 @@ func (cmd *clone) cloneVM(ctx context.Context, systemDisk *api.VSphereSystemDisk
 		return nil, errors.Wrap(err, "listing template VM devices failed")
 	}
 
-	// prepare virtual device config spec for network card
-	configSpecs := []types.BaseVirtualDeviceConfigSpec{}
-
-	if cmd.NetworkFlag.IsSet() {
-		op := types.VirtualDeviceConfigSpecOperationAdd
-		card, derr := cmd.NetworkFlag.Device()
-		if derr != nil {
-			return nil, errors.Wrap(derr, "preparing network device failed")
-		}
-		// search for the first network card of the source
-		for _, device := range devices {
-			if _, ok := device.(types.BaseVirtualEthernetCard); ok {
-				op = types.VirtualDeviceConfigSpecOperationEdit
-				// set new backing info
-				cmd.NetworkFlag.Change(device, card)
-				card = device
-				break
-			}
-		}
-
-		configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
-			Operation: op,
-			Device:    card,
-		})
+	// prepare virtual device config specs for network cards
+	configSpecs, nicCards, err := cmd.networkDeviceChanges(devices)
+	if err != nil {
+		return nil, err
 	}
+	cmd.nicCards = nicCards
 
 	folderref := cmd.Folder.Reference()
 	poolref := cmd.ResourcePool.Reference()
@@ -490,6 +786,15 @@ func (cmd *clone) cloneVM(ctx context.Context, systemDisk *api.VSphereSystemDisk
 		Template: false,
 	}
 
+	if cmd.spec.LinkedClone {
+		snapshot, err := cmd.templateSnapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cloneSpec.Snapshot = snapshot
+		relocateSpec.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	}
+
 	cloneSpec.Location = relocateSpec
 	vmref := cmd.VirtualMachine.Reference()
 
@@ -533,6 +838,11 @@ func (cmd *clone) cloneVM(ctx context.Context, systemDisk *api.VSphereSystemDisk
 		datastoreref = recommendations[0].Action[0].(*types.StoragePlacementAction).Destination
 	} else if cmd.StoragePod == nil && cmd.Datastore != nil {
 		datastoreref = cmd.Datastore.Reference()
+	} else if cmd.usesStoragePolicyPlacement() {
+		datastoreref, err = cmd.compatibleDatastore(ctx, cmd.profileID)
+		if err != nil {
+			return nil, err
+		}
 	} else if cmd.Cluster != nil {
 		spec := types.PlacementSpec{
 			PlacementType: string(types.PlacementSpecPlacementTypeClone),
@@ -562,80 +872,51 @@ func (cmd *clone) cloneVM(ctx context.Context, systemDisk *api.VSphereSystemDisk
 	// Set the destination datastore
 	cloneSpec.Location.Datastore = &datastoreref
 
-	if systemDisk != nil {
-		found := false
-		for _, device := range devices {
-			if disk, ok := device.(*types.VirtualDisk); ok {
-				// find first disk and change its size
-				oldSizeInBytes := diskCapacity(disk)
-				newSizeInBytes := int64(systemDisk.Size) * 1024 * 1024 * 1024
-				if newSizeInBytes < oldSizeInBytes {
-					return nil, fmt.Errorf("cannot shrink system disk size from %d to %d", oldSizeInBytes, newSizeInBytes)
-				}
-				disk.CapacityInBytes = newSizeInBytes
-				disk.CapacityInKB = newSizeInBytes / 1024
-				if cloneSpec.Config == nil {
-					cloneSpec.Config = &types.VirtualMachineConfigSpec{}
-				}
-				cloneSpec.Config.DeviceChange = append(cloneSpec.Config.DeviceChange, &types.VirtualDeviceConfigSpec{
-					Operation: types.VirtualDeviceConfigSpecOperationEdit,
-					Device:    disk,
-				})
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil, fmt.Errorf("system disk device not found")
+	// apply the storage policy to the VM home and the disks of the template
+	if cmd.profileID != "" {
+		cloneSpec.Location.Profile = storageProfileSpec(cmd.profileID)
+		for _, disk := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+			cloneSpec.Location.Disk = append(cloneSpec.Location.Disk, types.VirtualMachineRelocateSpecDiskLocator{
+				DiskId:       disk.GetVirtualDevice().Key,
+				Datastore:    datastoreref,
+				DiskMoveType: cloneSpec.Location.DiskMoveType,
+				Profile:      storageProfileSpec(cmd.profileID),
+			})
 		}
 	}
 
-	// Check if vmx already exists
-	force := flags.GetSpecFromPseudoFlagset(ctx).Force
-	if !force {
-		vmxPath := fmt.Sprintf("%s/%s.vmx", cmd.name, cmd.name)
-
-		var mds mo.Datastore
-		err = property.DefaultCollector(cmd.Client).RetrieveOne(ctx, datastoreref, []string{"name"}, &mds)
+	// the system disk of a linked clone is resized after cloning
+	if systemDisk != nil && !cmd.spec.LinkedClone {
+		diskSpec, err := systemDiskDeviceChange(devices, systemDisk)
 		if err != nil {
 			return nil, err
 		}
-
-		datastore := object.NewDatastore(cmd.Client, datastoreref)
-		datastore.InventoryPath = mds.Name
-
-		_, err := datastore.Stat(ctx, vmxPath)
-		if err == nil {
-			dsPath := vmxPath
-			if cmd.Datastore != nil {
-				dsPath = cmd.Datastore.Path(vmxPath)
-			}
-			return nil, fmt.Errorf("file %s already exists (use VsphereMachineClassSpec.Force=true to overwrite)", dsPath)
+		if cloneSpec.Config == nil {
+			cloneSpec.Config = &types.VirtualMachineConfigSpec{}
 		}
+		cloneSpec.Config.DeviceChange = append(cloneSpec.Config.DeviceChange, diskSpec)
 	}
 
-	// check if customization specification requested
-	customization := flags.GetSpecFromPseudoFlagset(ctx).Customization
-	if len(customization) > 0 {
-		// get the customization spec manager
-		customizationSpecManager := object.NewCustomizationSpecManager(cmd.Client)
-		// check if customization specification exists
-		exists, err := customizationSpecManager.DoesCustomizationSpecExist(ctx, customization)
+	if len(cmd.spec.DataDisks) > 0 {
+		diskSpecs, err := cmd.dataDiskDeviceChanges(ctx, devices, datastoreref)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "preparing data disks failed")
 		}
-		if !exists {
-			return nil, fmt.Errorf("customization specification %s does not exists", customization)
-		}
-		// get the customization specification
-		customSpecItem, err := customizationSpecManager.GetCustomizationSpec(ctx, customization)
-		if err != nil {
-			return nil, errors.Wrap(err, "GetCustomizationSpec failed")
+		if cloneSpec.Config == nil {
+			cloneSpec.Config = &types.VirtualMachineConfigSpec{}
 		}
-		customSpec := customSpecItem.Spec
-		// set the customization
-		cloneSpec.Customization = &customSpec
+		cloneSpec.Config.DeviceChange = append(cloneSpec.Config.DeviceChange, diskSpecs...)
+	}
+
+	if err = cmd.checkVMXExists(ctx, datastoreref); err != nil {
+		return nil, err
+	}
+
+	customSpec, err := cmd.customizationSpec(ctx)
+	if err != nil {
+		return nil, err
 	}
+	cloneSpec.Customization = customSpec
 
 	task, err := cmd.VirtualMachine.Clone(ctx, cmd.Folder, cmd.name, *cloneSpec)
 	if err != nil {
@@ -652,9 +933,216 @@ func (cmd *clone) cloneVM(ctx context.Context, systemDisk *api.VSphereSystemDisk
 	return object.NewVirtualMachine(cmd.Client, info.Result.(types.ManagedObjectReference)), nil
 }
 
-func diskCapacity(disk *types.VirtualDisk) int64 {
-	if disk.CapacityInBytes > 0 {
-		return disk.CapacityInBytes
+// checkVMXExists returns an error if the vmx file of the VM already exists on the datastore,
+// unless the spec forces to overwrite it.
+func (cmd *clone) checkVMXExists(ctx context.Context, datastoreref types.ManagedObjectReference) error {
+	if flags.GetSpecFromPseudoFlagset(ctx).Force {
+		return nil
+	}
+	vmxPath := fmt.Sprintf("%s/%s.vmx", cmd.name, cmd.name)
+
+	var mds mo.Datastore
+	if err := property.DefaultCollector(cmd.Client).RetrieveOne(ctx, datastoreref, []string{"name"}, &mds); err != nil {
+		return err
+	}
+
+	datastore := object.NewDatastore(cmd.Client, datastoreref)
+	datastore.InventoryPath = mds.Name
+
+	if _, err := datastore.Stat(ctx, vmxPath); err == nil {
+		dsPath := vmxPath
+		if cmd.Datastore != nil {
+			dsPath = cmd.Datastore.Path(vmxPath)
+		}
+		return fmt.Errorf("file %s already exists (use VsphereMachineClassSpec.Force=true to overwrite)", dsPath)
+	}
+	return nil
+}
+
+// customizationSpec returns the requested customization specification or nil.
+// The network settings are replaced if the network interfaces are configured statically.
+func (cmd *clone) customizationSpec(ctx context.Context) (*types.CustomizationSpec, error) {
+	customization := flags.GetSpecFromPseudoFlagset(ctx).Customization
+	if len(customization) == 0 {
+		return cmd.bootstrapCustomizationSpec(nil)
+	}
+	// get the customization spec manager
+	customizationSpecManager := object.NewCustomizationSpecManager(cmd.Client)
+	// check if customization specification exists
+	exists, err := customizationSpecManager.DoesCustomizationSpecExist(ctx, customization)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("customization specification %s does not exists", customization)
+	}
+	// get the customization specification
+	customSpecItem, err := customizationSpecManager.GetCustomizationSpec(ctx, customization)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetCustomizationSpec failed")
+	}
+	customSpec := customSpecItem.Spec
+	if hasStaticNetworking(cmd.spec) {
+		// replace network settings of the customization specification by the network interfaces of the spec
+		mappings, globalIPSettings, err := customizationNetworkSettings(cmd.spec)
+		if err != nil {
+			return nil, errors.Wrap(err, "preparing customization network settings failed")
+		}
+		customSpec.NicSettingMap = mappings
+		customSpec.GlobalIPSettings = globalIPSettings
+	}
+	return cmd.bootstrapCustomizationSpec(&customSpec)
+}
+
+// bootstrapCustomizationSpec sets the identity settings if the bootstrap format passes the user data by
+// guest customization. Without customization specification, a new one is created with the network settings of the spec.
+func (cmd *clone) bootstrapCustomizationSpec(customSpec *types.CustomizationSpec) (*types.CustomizationSpec, error) {
+	if cmd.spec.Bootstrap == nil || cmd.spec.Bootstrap.Format == "" {
+		return customSpec, nil
+	}
+	strategy, err := bootstrapStrategyFor(cmd.spec.Bootstrap.Format)
+	if err != nil {
+		return nil, err
+	}
+	customizationStrategy, ok := strategy.(customizationBootstrapStrategy)
+	if !ok {
+		return customSpec, nil
+	}
+
+	sshkeys := make([]string, len(cmd.spec.SSHKeys))
+	for i := range cmd.spec.SSHKeys {
+		sshkeys[i] = strings.TrimSpace(cmd.spec.SSHKeys[i])
+	}
+	identity, err := customizationStrategy.customizationIdentity(&bootstrapInput{
+		spec:     cmd.spec,
+		hostname: cmd.name,
+		userData: cmd.userData,
+		sshKeys:  sshkeys,
+		console:  cmd.console,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "preparing bootstrap data (%s) failed", cmd.spec.Bootstrap.Format)
+	}
+	if customSpec == nil {
+		mappings, globalIPSettings, err := customizationNetworkSettings(cmd.spec)
+		if err != nil {
+			return nil, errors.Wrap(err, "preparing customization network settings failed")
+		}
+		if len(mappings) == 0 {
+			// single network card of the template or the network flag
+			mappings = []types.CustomizationAdapterMapping{{Adapter: types.CustomizationIPSettings{Ip: &types.CustomizationDhcpIpGenerator{}}}}
+		}
+		customSpec = &types.CustomizationSpec{NicSettingMap: mappings, GlobalIPSettings: globalIPSettings}
+	}
+	customSpec.Identity = identity
+	return customSpec, nil
+}
+
+// networkDeviceChanges returns the device changes to apply the network interfaces to the network cards of the template.
+// The template cards are edited in order. If the networks are given as list, missing cards are added and
+// surplus cards are removed, otherwise only the first card is changed. A card with a different adapter type is
+// replaced by a new card, which is appended to the device list.
+// The returned cards are the edited or added card for each network interface, see matchNetworkCards.
+func (cmd *clone) networkDeviceChanges(devices object.VirtualDeviceList) ([]types.BaseVirtualDeviceConfigSpec, []types.BaseVirtualDevice, error) {
+	var (
+		configSpecs []types.BaseVirtualDeviceConfigSpec
+		nicCards    []types.BaseVirtualDevice
+	)
+
+	cards := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+	for i, networkFlag := range cmd.NetworkFlags {
+		if i >= len(cards) && len(cmd.spec.Networks) > 0 && networkFlag.Adapter() == "" {
+			_ = networkFlag.SetAdapter(defaultAdapterType)
+		}
+		card, err := networkFlag.Device()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "preparing network device %q failed", networkFlag.String())
+		}
+
+		if i < len(cards) {
+			current := cards[i]
+			if networkFlag.Adapter() == "" || devices.TypeName(current) == devices.TypeName(card) {
+				// set new backing info
+				networkFlag.Change(current, card)
+				configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+					Operation: types.VirtualDeviceConfigSpecOperationEdit,
+					Device:    current,
+				})
+				nicCards = append(nicCards, current)
+				continue
+			}
+			// adapter type differs, replace the card
+			configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    current,
+			})
+		}
+
+		configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    card,
+		})
+		nicCards = append(nicCards, card)
+	}
+
+	if len(cmd.spec.Networks) > 0 {
+		for i := len(cmd.NetworkFlags); i < len(cards); i++ {
+			configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    cards[i],
+			})
+		}
+	}
+
+	return configSpecs, nicCards, nil
+}
+
+// templateSnapshot returns the snapshot of the template to create a linked clone from.
+// If no snapshot name is specified, the current snapshot is used.
+func (cmd *clone) templateSnapshot(ctx context.Context) (*types.ManagedObjectReference, error) {
+	var props mo.VirtualMachine
+	if err := cmd.VirtualMachine.Properties(ctx, cmd.VirtualMachine.Reference(), []string{"snapshot"}, &props); err != nil {
+		return nil, errors.Wrap(err, "retrieving snapshot of template VM failed")
+	}
+	return selectSnapshot(props.Snapshot, cmd.spec.TemplateSnapshot, cmd.VirtualMachine.InventoryPath)
+}
+
+// selectSnapshot returns the snapshot with the given name, path or id, or the current snapshot if no name is given.
+// A missing snapshot is returned as InvalidArgumentError, as a retry cannot succeed.
+func selectSnapshot(info *types.VirtualMachineSnapshotInfo, name, template string) (*types.ManagedObjectReference, error) {
+	if name == "" {
+		if info == nil || info.CurrentSnapshot == nil {
+			return nil, &errors2.InvalidArgumentError{Message: fmt.Sprintf("linked clone requires a snapshot, but template %s has none", template)}
+		}
+		return info.CurrentSnapshot, nil
+	}
+
+	var found []types.ManagedObjectReference
+	if info != nil {
+		found = findSnapshots(info.RootSnapshotList, "", name)
+	}
+	switch len(found) {
+	case 0:
+		return nil, &errors2.InvalidArgumentError{Message: fmt.Sprintf("linked clone: snapshot %q of template %s not found", name, template)}
+	case 1:
+		return &found[0], nil
+	default:
+		return nil, &errors2.InvalidArgumentError{Message: fmt.Sprintf("linked clone: snapshot %q of template %s resolves to %d snapshots", name, template, len(found))}
+	}
+}
+
+// findSnapshots returns the snapshots of the tree matching the name, the path of names separated by `/` or the id
+func findSnapshots(trees []types.VirtualMachineSnapshotTree, parent, name string) []types.ManagedObjectReference {
+	var found []types.ManagedObjectReference
+	for _, tree := range trees {
+		path := tree.Name
+		if parent != "" {
+			path = parent + "/" + tree.Name
+		}
+		if tree.Name == name || path == name || tree.Snapshot.Value == name {
+			found = append(found, tree.Snapshot)
+		}
+		found = append(found, findSnapshots(tree.ChildSnapshotList, path, name)...)
 	}
-	return disk.CapacityInKB * 1024
+	return found
 }
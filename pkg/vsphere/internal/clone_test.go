@@ -0,0 +1,331 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	errors2 "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/errors"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
+)
+
+func TestResourceAllocation(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(resourceAllocation(nil)).To(gomega.BeNil())
+
+	reservation := int64(1000)
+	info := resourceAllocation(&api.VSphereResourceAllocation{Reservation: &reservation})
+	g.Expect(*info.Reservation).To(gomega.Equal(int64(1000)))
+	g.Expect(info.Limit).To(gomega.BeNil())
+	g.Expect(info.Shares).To(gomega.BeNil())
+
+	limit := int64(-1)
+	info = resourceAllocation(&api.VSphereResourceAllocation{Limit: &limit, Shares: api.SharesLevelCustom, CustomShares: 2000})
+	g.Expect(*info.Limit).To(gomega.Equal(int64(-1)))
+	g.Expect(*info.Shares).To(gomega.Equal(types.SharesInfo{Level: types.SharesLevelCustom, Shares: 2000}))
+}
+
+func TestNumaExtraConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(numaExtraConfig(nil)).To(gomega.BeEmpty())
+
+	follow := true
+	extraConfig := numaExtraConfig(&api.VSphereNUMA{MaxVCPUsPerNode: 8, MinVCPUs: 4, FollowCoresPerSocket: &follow})
+	g.Expect(extraConfig).To(gomega.Equal(map[string]string{
+		"numa.vcpu.maxPerVirtualNode":    "8",
+		"numa.vcpu.min":                  "4",
+		"numa.vcpu.followcorespersocket": "TRUE",
+	}))
+}
+
+func TestLatestHardwareVersion(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	host1 := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	host2 := types.ManagedObjectReference{Type: "HostSystem", Value: "host-2"}
+	descriptors := []types.VirtualMachineConfigOptionDescriptor{
+		{Key: "vmx-13", Host: []types.ManagedObjectReference{host1, host2}, RunSupported: types.NewBool(true)},
+		{Key: "vmx-19", Host: []types.ManagedObjectReference{host1, host2}, RunSupported: types.NewBool(true)},
+		{Key: "vmx-20", Host: []types.ManagedObjectReference{host2}, RunSupported: types.NewBool(true)},
+		{Key: "vmx-21", Host: []types.ManagedObjectReference{host2}, RunSupported: types.NewBool(false)},
+	}
+	g.Expect(latestHardwareVersion(descriptors, &host1)).To(gomega.Equal("vmx-19"))
+	g.Expect(latestHardwareVersion(descriptors, &host2)).To(gomega.Equal("vmx-20"))
+	g.Expect(latestHardwareVersion(descriptors, nil)).To(gomega.Equal("vmx-20"))
+	g.Expect(latestHardwareVersion(nil, nil)).To(gomega.Equal(""))
+}
+
+func TestParseHardwareVersion(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	version, err := parseHardwareVersion("vmx-09")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(version).To(gomega.Equal(9))
+
+	_, err = parseHardwareVersion("latest")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestRenderTemplates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cmd := newClone("machine1", &api.VsphereProviderSpec{
+		VApp: &api.VApp{
+			Properties:     map[string]string{"hostname": "{{ .MachineName }}"},
+			PropertiesFrom: map[string]api.VSphereValueSource{"token": {SecretKey: "registryToken"}},
+		},
+		ExtraConfigFrom: map[string]api.VSphereValueSource{"guestinfo.password": {SecretKey: "joinPassword"}},
+	}, "#cloud-config\n")
+	cmd.secretData = map[string][]byte{"registryToken": []byte("{{ not rendered }}"), "joinPassword": []byte("secret")}
+	g.Expect(cmd.renderTemplates()).To(gomega.Succeed())
+	g.Expect(cmd.vapp.Properties).To(gomega.Equal(map[string]string{"hostname": "machine1", "token": "{{ not rendered }}"}))
+	g.Expect(cmd.extraConfig).To(gomega.Equal(map[string]string{"guestinfo.password": "secret"}))
+
+	delete(cmd.secretData, "joinPassword")
+	g.Expect(cmd.renderTemplates()).NotTo(gomega.Succeed())
+}
+
+func TestAddSecretValues(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cmd := &clone{secretData: map[string][]byte{
+		"registryToken":   []byte("token"),
+		"vspherePassword": []byte("secret"),
+	}}
+
+	values, err := cmd.addSecretValues(nil, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(values).To(gomega.BeNil())
+
+	values, err = cmd.addSecretValues(nil, map[string]api.VSphereValueSource{"token": {SecretKey: "registryToken"}})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(values).To(gomega.Equal(map[string]string{"token": "token"}))
+
+	values, err = cmd.addSecretValues(map[string]string{"plain": "value"}, map[string]api.VSphereValueSource{"token": {SecretKey: "registryToken"}})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(values).To(gomega.Equal(map[string]string{"plain": "value", "token": "token"}))
+
+	_, err = cmd.addSecretValues(nil, map[string]api.VSphereValueSource{"token": {SecretKey: "missing"}})
+	g.Expect(err).To(gomega.MatchError("token: secret key missing not found"))
+
+	_, err = cmd.addSecretValues(nil, map[string]api.VSphereValueSource{"password": {SecretKey: "vspherePassword"}})
+	g.Expect(err).To(gomega.MatchError("password: secret key vspherePassword must not be passed to the VM"))
+}
+
+func TestHardwareConfigSpec(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	btrue := true
+	bfalse := false
+
+	configSpec := hardwareConfigSpec(&api.VsphereProviderSpec{})
+	g.Expect(configSpec.NumCPUs).To(gomega.BeZero())
+	g.Expect(configSpec.MemoryMB).To(gomega.BeZero())
+	g.Expect(configSpec.Firmware).To(gomega.BeEmpty())
+	g.Expect(configSpec.BootOptions).To(gomega.BeNil())
+	g.Expect(configSpec.NestedHVEnabled).To(gomega.BeNil())
+	g.Expect(configSpec.Flags).To(gomega.Equal(&types.VirtualMachineFlagInfo{DiskUuidEnabled: &btrue}))
+
+	configSpec = hardwareConfigSpec(&api.VsphereProviderSpec{
+		NumCpus:            4,
+		Memory:             8192,
+		CoresPerSocket:     2,
+		GuestID:            "ubuntu64Guest",
+		LatencySensitivity: api.LatencySensitivityHigh,
+		Firmware:           api.FirmwareEFI,
+		SecureBoot:         &btrue,
+		NestedHV:           &bfalse,
+	})
+	g.Expect(configSpec.NumCPUs).To(gomega.Equal(int32(4)))
+	g.Expect(configSpec.MemoryMB).To(gomega.Equal(int64(8192)))
+	g.Expect(configSpec.NumCoresPerSocket).To(gomega.Equal(int32(2)))
+	g.Expect(configSpec.GuestId).To(gomega.Equal("ubuntu64Guest"))
+	g.Expect(configSpec.LatencySensitivity).To(gomega.Equal(&types.LatencySensitivity{Level: types.LatencySensitivitySensitivityLevelHigh}))
+	g.Expect(configSpec.Firmware).To(gomega.Equal("efi"))
+	g.Expect(configSpec.BootOptions).To(gomega.Equal(&types.VirtualMachineBootOptions{EfiSecureBootEnabled: &btrue}))
+	g.Expect(configSpec.NestedHVEnabled).To(gomega.Equal(&bfalse))
+	g.Expect(configSpec.Flags.VbsEnabled).To(gomega.BeNil())
+
+	// virtualization-based security enables nested hardware virtualization and IOMMU
+	configSpec = hardwareConfigSpec(&api.VsphereProviderSpec{Firmware: api.FirmwareEFI, SecureBoot: &btrue, NestedHV: &bfalse, VBS: &btrue})
+	g.Expect(configSpec.NestedHVEnabled).To(gomega.Equal(&btrue))
+	g.Expect(configSpec.Flags).To(gomega.Equal(&types.VirtualMachineFlagInfo{DiskUuidEnabled: &btrue, VbsEnabled: &btrue, VvtdEnabled: &btrue}))
+
+	configSpec = hardwareConfigSpec(&api.VsphereProviderSpec{VBS: &bfalse})
+	g.Expect(configSpec.NestedHVEnabled).To(gomega.BeNil())
+	g.Expect(configSpec.Flags).To(gomega.Equal(&types.VirtualMachineFlagInfo{DiskUuidEnabled: &btrue, VbsEnabled: &bfalse}))
+}
+
+// testNetwork is a standard port group resolved without vSphere
+type testNetwork string
+
+func (n testNetwork) Reference() types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "Network", Value: string(n)}
+}
+
+func (n testNetwork) GetInventoryPath() string {
+	return "/dc1/network/" + string(n)
+}
+
+func (n testNetwork) EthernetCardBackingInfo(_ context.Context) (types.BaseVirtualDeviceBackingInfo, error) {
+	return &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: string(n)},
+	}, nil
+}
+
+func testNetworkCard(adapter string, key int32, network, mac string) types.BaseVirtualDevice {
+	backing, _ := testNetwork(network).EthernetCardBackingInfo(context.TODO())
+	card, _ := object.EthernetCardTypes().CreateEthernetCard(adapter, backing)
+	card.GetVirtualDevice().Key = key
+	card.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard().MacAddress = mac
+	return card
+}
+
+func newTestNetworkClone(spec *api.VsphereProviderSpec) *clone {
+	cmd := newClone("machine1", spec, "")
+	ctx := flags.ContextWithPseudoFlagset(context.TODO(), &govmomi.Client{}, spec)
+	for _, nic := range spec.Networks {
+		networkFlag, _ := flags.NewCustomNetworkFlag(ctx, nic.Name, "", nic.AdapterType)
+		networkFlag.SetNetwork(testNetwork(nic.Name))
+		cmd.NetworkFlags = append(cmd.NetworkFlags, networkFlag)
+	}
+	return cmd
+}
+
+func TestNetworkDeviceChanges(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	template := object.VirtualDeviceList{
+		testNetworkCard("vmxnet3", 4000, "template", ""),
+		testNetworkCard("e1000", 4001, "template", ""),
+	}
+	spec := &api.VsphereProviderSpec{
+		Networks: []api.VSphereNetworkInterface{
+			{Name: "net1"},
+			{Name: "net2", AdapterType: "vmxnet3", IPAddresses: []string{"10.0.2.10/24"}},
+			{Name: "net3", IPAddresses: []string{"10.0.3.10/24"}},
+		},
+	}
+	cmd := newTestNetworkClone(spec)
+
+	// edit the first card, replace the second one as the adapter type differs and add the third one
+	configSpecs, nicCards, err := cmd.networkDeviceChanges(template)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(configSpecs).To(gomega.HaveLen(4))
+	operations := make([]types.VirtualDeviceConfigSpecOperation, len(configSpecs))
+	for i, configSpec := range configSpecs {
+		operations[i] = configSpec.GetVirtualDeviceConfigSpec().Operation
+	}
+	g.Expect(operations).To(gomega.Equal([]types.VirtualDeviceConfigSpecOperation{
+		types.VirtualDeviceConfigSpecOperationEdit,
+		types.VirtualDeviceConfigSpecOperationRemove,
+		types.VirtualDeviceConfigSpecOperationAdd,
+		types.VirtualDeviceConfigSpecOperationAdd,
+	}))
+	g.Expect(configSpecs[1].GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().Key).To(gomega.Equal(int32(4001)))
+	g.Expect(nicCards).To(gomega.HaveLen(3))
+	g.Expect(nicCards[0].GetVirtualDevice().Key).To(gomega.Equal(int32(4000)))
+	for i, name := range []string{"net1", "net2", "net3"} {
+		backing := nicCards[i].GetVirtualDevice().Backing.(*types.VirtualEthernetCardNetworkBackingInfo)
+		g.Expect(backing.DeviceName).To(gomega.Equal(name))
+		g.Expect(template.TypeName(nicCards[i])).To(gomega.Equal("VirtualVmxnet3"))
+	}
+
+	// the added cards are appended by vSphere in any key order, the interfaces are matched by backing
+	cloned := object.VirtualDeviceList{
+		testNetworkCard("vmxnet3", 4000, "net1", "00:50:56:00:00:01"),
+		testNetworkCard("vmxnet3", 4001, "net3", "00:50:56:00:00:03"),
+		testNetworkCard("vmxnet3", 4002, "net2", "00:50:56:00:00:02"),
+	}
+	nics, err := newGuestNetworkInterfaces(spec, cloned, nicCards)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(nics).To(gomega.HaveLen(3))
+	g.Expect(nics[0].MACAddress).To(gomega.Equal("00:50:56:00:00:01"))
+	g.Expect(nics[1].MACAddress).To(gomega.Equal("00:50:56:00:00:02"))
+	g.Expect(nics[1].IPAddresses).To(gomega.Equal([]string{"10.0.2.10/24"}))
+	g.Expect(nics[2].MACAddress).To(gomega.Equal("00:50:56:00:00:03"))
+
+	_, err = newGuestNetworkInterfaces(spec, cloned[:2], nicCards)
+	g.Expect(err).To(gomega.MatchError("network card of network interface 1 not found"))
+
+	// surplus cards of the template are removed
+	cmd = newTestNetworkClone(&api.VsphereProviderSpec{Networks: []api.VSphereNetworkInterface{{Name: "net1"}}})
+	configSpecs, nicCards, err = cmd.networkDeviceChanges(template)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(configSpecs).To(gomega.HaveLen(2))
+	g.Expect(configSpecs[0].GetVirtualDeviceConfigSpec().Operation).To(gomega.Equal(types.VirtualDeviceConfigSpecOperationEdit))
+	g.Expect(configSpecs[1].GetVirtualDeviceConfigSpec().Operation).To(gomega.Equal(types.VirtualDeviceConfigSpecOperationRemove))
+	g.Expect(configSpecs[1].GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().Key).To(gomega.Equal(int32(4001)))
+	g.Expect(nicCards).To(gomega.HaveLen(1))
+}
+
+func TestSelectSnapshot(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	snapshotRef := func(value string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: value}
+	}
+	current := snapshotRef("snapshot-3")
+	info := &types.VirtualMachineSnapshotInfo{
+		CurrentSnapshot: &current,
+		RootSnapshotList: []types.VirtualMachineSnapshotTree{
+			{
+				Name:     "base",
+				Snapshot: snapshotRef("snapshot-1"),
+				ChildSnapshotList: []types.VirtualMachineSnapshotTree{
+					{Name: "v1", Snapshot: snapshotRef("snapshot-2")},
+					{Name: "v2", Snapshot: snapshotRef("snapshot-3")},
+				},
+			},
+			{Name: "v1", Snapshot: snapshotRef("snapshot-4")},
+		},
+	}
+
+	snapshot, err := selectSnapshot(info, "", "template")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(*snapshot).To(gomega.Equal(current))
+
+	snapshot, err = selectSnapshot(info, "v2", "template")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(*snapshot).To(gomega.Equal(snapshotRef("snapshot-3")))
+
+	snapshot, err = selectSnapshot(info, "base/v1", "template")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(*snapshot).To(gomega.Equal(snapshotRef("snapshot-2")))
+
+	snapshot, err = selectSnapshot(info, "snapshot-4", "template")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(*snapshot).To(gomega.Equal(snapshotRef("snapshot-4")))
+
+	// missing and ambiguous snapshots cannot be fixed by a retry
+	for _, name := range []string{"v3", "v1"} {
+		_, err = selectSnapshot(info, name, "template")
+		g.Expect(err).To(gomega.BeAssignableToTypeOf(&errors2.InvalidArgumentError{}))
+	}
+	_, err = selectSnapshot(nil, "", "template")
+	g.Expect(err).To(gomega.MatchError(&errors2.InvalidArgumentError{Message: "linked clone requires a snapshot, but template template has none"}))
+	_, err = selectSnapshot(nil, "v1", "template")
+	g.Expect(err).To(gomega.BeAssignableToTypeOf(&errors2.InvalidArgumentError{}))
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"os"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	secretConsolePassword     = "consolePassword"
+	secretConsolePasswordHash = "consolePasswordHash"
+
+	// envPasswordFromEnv enables the deprecated fallback to the controller-wide environment variables
+	// envPassword and envPasswordHash if the secret contains no console credentials
+	envPasswordFromEnv = "VMWARE_MACHINE_PASSWORD_FROM_ENV"
+)
+
+// envIgnoredWarning logs once that the environment variables are set, but not enabled
+var envIgnoredWarning sync.Once
+
+// consoleCredentials are used to login on the VM console for debugging purposes.
+// Login to machine happens normally via ssh and provided ssh keys.
+type consoleCredentials struct {
+	password     string
+	passwordHash string
+}
+
+// consoleCredentialsFrom returns the console credentials of the secret
+func consoleCredentialsFrom(secret *corev1.Secret) consoleCredentials {
+	credentials := consoleCredentials{
+		password:     string(secret.Data[secretConsolePassword]),
+		passwordHash: string(secret.Data[secretConsolePasswordHash]),
+	}
+	if credentials.isSet() {
+		return credentials
+	}
+	env := consoleCredentials{password: os.Getenv(envPassword), passwordHash: os.Getenv(envPasswordHash)}
+	if !env.isSet() {
+		return credentials
+	}
+	if os.Getenv(envPasswordFromEnv) != "true" {
+		envIgnoredWarning.Do(func() {
+			klog.Warningf("Console password from environment variables %s and %s is ignored, set %s=true to use it or use secret keys %s or %s instead",
+				envPassword, envPasswordHash, envPasswordFromEnv, secretConsolePassword, secretConsolePasswordHash)
+		})
+		return credentials
+	}
+	klog.Warningf("Console password from environment variables %s and %s is deprecated, use secret keys %s or %s instead",
+		envPassword, envPasswordHash, secretConsolePassword, secretConsolePasswordHash)
+	return env
+}
+
+// hash returns the configured password hash or the SHA-512 crypt hash of the password.
+// Without credentials, "*" is returned to disable password login.
+func (c consoleCredentials) hash() (string, error) {
+	if c.passwordHash != "" {
+		return c.passwordHash, nil
+	}
+	if c.password != "" {
+		return hashPassword(c.password)
+	}
+	return "*", nil
+}
+
+// isSet checks if a console password or password hash is configured
+func (c consoleCredentials) isSet() bool {
+	return c.password != "" || c.passwordHash != ""
+}
+
+// warnIgnored logs a warning if console credentials are configured for a bootstrap format not supporting them.
+// Credentials from the secret are already rejected by the validation.
+func (c consoleCredentials) warnIgnored(format string) {
+	if c.isSet() {
+		klog.Warningf("Console password is not supported by bootstrap format %s and ignored", format)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConsoleCredentialsFrom(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	t.Setenv(envPassword, "env-password")
+	t.Setenv(envPasswordHash, "")
+	t.Setenv(envPasswordFromEnv, "")
+
+	// without opt-in, the environment is ignored
+	credentials := consoleCredentialsFrom(&corev1.Secret{})
+	g.Expect(credentials.isSet()).To(gomega.BeFalse())
+	g.Expect(credentials.hash()).To(gomega.Equal("*"))
+
+	credentials = consoleCredentialsFrom(&corev1.Secret{Data: map[string][]byte{secretConsolePassword: []byte("secret")}})
+	g.Expect(credentials.password).To(gomega.Equal("secret"))
+	hash, err := credentials.hash()
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(strings.HasPrefix(hash, "$6$")).To(gomega.BeTrue())
+
+	// the configured hash takes precedence over hashing the password
+	credentials = consoleCredentialsFrom(&corev1.Secret{Data: map[string][]byte{
+		secretConsolePassword:     []byte("secret"),
+		secretConsolePasswordHash: []byte("$6$salt$hash"),
+	}})
+	g.Expect(credentials.hash()).To(gomega.Equal("$6$salt$hash"))
+
+	t.Setenv(envPasswordFromEnv, "true")
+	credentials = consoleCredentialsFrom(&corev1.Secret{})
+	g.Expect(credentials.password).To(gomega.Equal("env-password"))
+
+	// the secret takes precedence over the environment
+	credentials = consoleCredentialsFrom(&corev1.Secret{Data: map[string][]byte{secretConsolePasswordHash: []byte("$6$salt$hash")}})
+	g.Expect(credentials.password).To(gomega.BeEmpty())
+	g.Expect(credentials.passwordHash).To(gomega.Equal("$6$salt$hash"))
+}
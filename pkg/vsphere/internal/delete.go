@@ -29,6 +29,7 @@ import (
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
 )
 
 func findVM(ctx context.Context, client *govmomi.Client, providerSpec *api.VsphereProviderSpec, machineName, machineID string) (*object.VirtualMachine, error) {
@@ -174,17 +175,54 @@ func deleteVM(ctx context.Context, client *govmomi.Client, spec *api.VsphereProv
 	}
 	foundMachineID := vm.UUID(ctx)
 
-	task, err := vm.Destroy(ctx)
-	if err != nil {
-		return "", errors.Wrap(err, "starting Destroy failed")
+	// vSphere drops destroyed VMs from DRS rules and groups, so failing to clean them up must not block the deletion
+	if (spec.AntiAffinity != nil || spec.HostGroupAffinity != nil) && spec.ComputeCluster != "" {
+		if cluster, err := computeCluster(ctx, client, spec); err != nil {
+			klog.Warningf("Cleaning up DRS rules of VM %s failed: %s", machineName, err)
+		} else {
+			if spec.AntiAffinity != nil {
+				if err = removeFromAntiAffinityRule(ctx, spec, cluster, vm.Reference()); err != nil {
+					klog.Warningf("Removing VM %s from anti-affinity rule failed: %s", machineName, err)
+				}
+			}
+			if spec.HostGroupAffinity != nil {
+				if err = removeFromVMGroup(ctx, spec.HostGroupAffinity, cluster, vm.Reference()); err != nil {
+					klog.Warningf("Removing VM %s from VM group failed: %s", machineName, err)
+				}
+			}
+		}
 	}
-	_, err = task.WaitForResult(ctx, nil)
+
+	// seed ISO images are not deleted together with the VM. They are deleted first, as the VM
+	// is needed to find them again if the deletion is retried.
+	isoFiles, err := seedISOFiles(ctx, vm)
 	if err != nil {
-		return "", errors.Wrap(err, "Destroy failed")
+		return "", err
+	}
+	if err = deleteSeedISOFiles(ctx, client, spec, isoFiles); err != nil {
+		return "", errors.Wrap(err, "deleting seed ISO image failed")
 	}
+
+	if err = destroyVM(ctx, vm); err != nil {
+		return "", err
+	}
+	// IP addresses allocated from IP pools are recorded in a custom attribute of the VM,
+	// they are free for reuse as soon as the VM is destroyed
 	return foundMachineID, nil
 }
 
+// destroyVM destroys the powered off VM
+func destroyVM(ctx context.Context, vm *object.VirtualMachine) error {
+	task, err := vm.Destroy(ctx)
+	if err != nil {
+		return errors.Wrap(err, "starting Destroy failed")
+	}
+	if _, err = task.WaitForResult(ctx, nil); err != nil {
+		return errors.Wrap(err, "Destroy failed")
+	}
+	return nil
+}
+
 func doShutdown(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec, machineName, machineID string) (*object.VirtualMachine, error) {
 	vm, err := findVM(ctx, client, spec, machineName, machineID)
 	if err != nil {
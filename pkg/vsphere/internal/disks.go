@@ -0,0 +1,177 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
+)
+
+// dataDiskDeviceChanges returns the device changes to create the data disks of the spec.
+// Disks without explicit data store are placed on the given data store of the VM.
+// Missing controllers are added.
+func (cmd *clone) dataDiskDeviceChanges(ctx context.Context, devices object.VirtualDeviceList, datastoreref types.ManagedObjectReference) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	var configSpecs []types.BaseVirtualDeviceConfigSpec
+
+	// work on a copy to keep track of added controllers and used unit numbers
+	list := append(object.VirtualDeviceList{}, devices...)
+	for i, dataDisk := range cmd.spec.DataDisks {
+		controller, created, err := findOrCreateController(list, dataDisk.ControllerType, dataDisk.ControllerBusNumber)
+		if err != nil {
+			return nil, errors.Wrapf(err, "dataDisks[%d]", i)
+		}
+		if created {
+			list = append(list, controller.(types.BaseVirtualDevice))
+			configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationAdd,
+				Device:    controller.(types.BaseVirtualDevice),
+			})
+		}
+
+		dsref := datastoreref
+		fileName := ""
+		if dataDisk.Datastore != "" {
+			datastoreFlag, _ := flags.NewCustomDatastoreFlag(ctx)
+			datastoreFlag.Name = dataDisk.Datastore
+			ds, err := datastoreFlag.Datastore()
+			if err != nil {
+				return nil, errors.Wrapf(err, "dataDisks[%d]: preparing DatastoreFlag failed", i)
+			}
+			dsref = ds.Reference()
+			fileName = fmt.Sprintf("[%s]", ds.Name())
+		}
+
+		disk := list.CreateDisk(controller, dsref, "")
+		sizeInBytes := int64(dataDisk.Size) * 1024 * 1024 * 1024
+		disk.CapacityInBytes = sizeInBytes
+		disk.CapacityInKB = sizeInBytes / 1024
+
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		backing.FileName = fileName
+		if dataDisk.DiskMode != "" {
+			backing.DiskMode = dataDisk.DiskMode
+		}
+		switch dataDisk.ProvisioningType {
+		case api.ProvisioningTypeThick:
+			backing.ThinProvisioned = types.NewBool(false)
+		case api.ProvisioningTypeEagerZeroedThick:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(true)
+		}
+
+		profileID := cmd.profileID
+		if dataDisk.StoragePolicy != "" {
+			if profileID, err = cmd.storageProfileID(ctx, dataDisk.StoragePolicy); err != nil {
+				return nil, errors.Wrapf(err, "dataDisks[%d]", i)
+			}
+		}
+
+		list = append(list, disk)
+		configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+			Operation:     types.VirtualDeviceConfigSpecOperationAdd,
+			FileOperation: types.VirtualDeviceConfigSpecFileOperationCreate,
+			Device:        disk,
+			Profile:       storageProfileSpec(profileID),
+		})
+	}
+
+	return configSpecs, nil
+}
+
+// findOrCreateController returns the controller of the given type and bus number.
+// If it does not exist, a new controller is created, which must be added to the VM by the caller.
+func findOrCreateController(list object.VirtualDeviceList, controllerType string, busNumber *int) (types.BaseVirtualController, bool, error) {
+	bus := int32(0)
+	if busNumber != nil {
+		bus = int32(*busNumber)
+	}
+
+	var kind types.BaseVirtualDevice
+	switch controllerType {
+	case "", api.ControllerTypeSCSI:
+		kind = (*types.VirtualSCSIController)(nil)
+	case api.ControllerTypeNVME:
+		kind = (*types.VirtualNVMEController)(nil)
+	case api.ControllerTypeSATA:
+		kind = (*types.VirtualSATAController)(nil)
+	default:
+		return nil, false, fmt.Errorf("unsupported controller type %q", controllerType)
+	}
+	for _, device := range list.SelectByType(kind) {
+		controller := device.(types.BaseVirtualController)
+		if controller.GetVirtualController().BusNumber == bus {
+			return controller, false, nil
+		}
+	}
+
+	var device types.BaseVirtualDevice
+	switch controllerType {
+	case api.ControllerTypeNVME:
+		device, _ = list.CreateNVMEController()
+	case api.ControllerTypeSATA:
+		device = &types.VirtualAHCIController{
+			VirtualSATAController: types.VirtualSATAController{
+				VirtualController: types.VirtualController{
+					VirtualDevice: types.VirtualDevice{Key: list.NewKey()},
+				},
+			},
+		}
+	default:
+		var err error
+		if device, err = list.CreateSCSIController("pvscsi"); err != nil {
+			return nil, false, err
+		}
+	}
+	controller := device.(types.BaseVirtualController)
+	controller.GetVirtualController().BusNumber = bus
+	return controller, true, nil
+}
+
+// systemDiskDeviceChange returns the device change to resize the system disk, which is the first disk of the VM.
+func systemDiskDeviceChange(devices object.VirtualDeviceList, systemDisk *api.VSphereSystemDisk) (types.BaseVirtualDeviceConfigSpec, error) {
+	for _, device := range devices {
+		if disk, ok := device.(*types.VirtualDisk); ok {
+			// find first disk and change its size
+			oldSizeInBytes := diskCapacity(disk)
+			newSizeInBytes := int64(systemDisk.Size) * 1024 * 1024 * 1024
+			if newSizeInBytes < oldSizeInBytes {
+				return nil, fmt.Errorf("cannot shrink system disk size from %d to %d", oldSizeInBytes, newSizeInBytes)
+			}
+			disk.CapacityInBytes = newSizeInBytes
+			disk.CapacityInKB = newSizeInBytes / 1024
+			return &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationEdit,
+				Device:    disk,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("system disk device not found")
+}
+
+func diskCapacity(disk *types.VirtualDisk) int64 {
+	if disk.CapacityInBytes > 0 {
+		return disk.CapacityInBytes
+	}
+	return disk.CapacityInKB * 1024
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestFindOrCreateController(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scsi0 := &types.ParaVirtualSCSIController{}
+	scsi0.Key = 1000
+	scsi0.BusNumber = 0
+	list := object.VirtualDeviceList{scsi0}
+
+	controller, created, err := findOrCreateController(list, "", nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created).To(gomega.BeFalse())
+	g.Expect(controller).To(gomega.BeIdenticalTo(scsi0))
+
+	bus := 1
+	controller, created, err = findOrCreateController(list, api.ControllerTypeSCSI, &bus)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created).To(gomega.BeTrue())
+	g.Expect(controller).To(gomega.BeAssignableToTypeOf(&types.ParaVirtualSCSIController{}))
+	g.Expect(controller.GetVirtualController().BusNumber).To(gomega.Equal(int32(1)))
+	g.Expect(controller.GetVirtualController().Key < 0).To(gomega.BeTrue())
+
+	controller, created, err = findOrCreateController(list, api.ControllerTypeNVME, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created).To(gomega.BeTrue())
+	g.Expect(controller).To(gomega.BeAssignableToTypeOf(&types.VirtualNVMEController{}))
+
+	controller, created, err = findOrCreateController(list, api.ControllerTypeSATA, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created).To(gomega.BeTrue())
+	g.Expect(controller).To(gomega.BeAssignableToTypeOf(&types.VirtualAHCIController{}))
+}
+
+func TestDataDiskDeviceChanges(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scsi0 := &types.ParaVirtualSCSIController{}
+	scsi0.Key = 1000
+	scsi0.BusNumber = 0
+	devices := object.VirtualDeviceList{scsi0}
+	datastoreref := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}
+
+	bus1 := 1
+	spec := &api.VsphereProviderSpec{
+		DataDisks: []api.VSphereDataDisk{
+			{Size: 10},
+			{Size: 20, ProvisioningType: api.ProvisioningTypeThick, ControllerBusNumber: &bus1},
+			{Size: 30, ProvisioningType: api.ProvisioningTypeEagerZeroedThick, ControllerType: api.ControllerTypeNVME},
+			{Size: 40, ControllerBusNumber: &bus1},
+		},
+	}
+	cmd := newClone("machine1", spec, "")
+
+	configSpecs, err := cmd.dataDiskDeviceChanges(context.TODO(), devices, datastoreref)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	// one controller each for SCSI bus 1 and NVMe, one device change per disk
+	g.Expect(configSpecs).To(gomega.HaveLen(6))
+	for _, configSpec := range configSpecs {
+		g.Expect(configSpec.GetVirtualDeviceConfigSpec().Operation).To(gomega.Equal(types.VirtualDeviceConfigSpecOperationAdd))
+	}
+
+	diskSpec := func(i int) (*types.VirtualDisk, *types.VirtualDiskFlatVer2BackingInfo) {
+		configSpec := configSpecs[i].GetVirtualDeviceConfigSpec()
+		g.Expect(configSpec.FileOperation).To(gomega.Equal(types.VirtualDeviceConfigSpecFileOperationCreate))
+		g.Expect(configSpec.Profile).To(gomega.BeNil())
+		disk, ok := configSpec.Device.(*types.VirtualDisk)
+		g.Expect(ok).To(gomega.BeTrue())
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		g.Expect(backing.Datastore).To(gomega.Equal(&datastoreref))
+		return disk, backing
+	}
+
+	disk, backing := diskSpec(0)
+	g.Expect(disk.ControllerKey).To(gomega.Equal(scsi0.Key))
+	g.Expect(disk.CapacityInBytes).To(gomega.Equal(int64(10 * 1024 * 1024 * 1024)))
+	g.Expect(disk.CapacityInKB).To(gomega.Equal(int64(10 * 1024 * 1024)))
+	g.Expect(*backing.ThinProvisioned).To(gomega.BeTrue())
+
+	scsi1, ok := configSpecs[1].GetVirtualDeviceConfigSpec().Device.(*types.ParaVirtualSCSIController)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(scsi1.BusNumber).To(gomega.Equal(int32(1)))
+	disk, backing = diskSpec(2)
+	g.Expect(disk.ControllerKey).To(gomega.Equal(scsi1.Key))
+	g.Expect(*backing.ThinProvisioned).To(gomega.BeFalse())
+	g.Expect(backing.EagerlyScrub).To(gomega.BeNil())
+
+	nvme, ok := configSpecs[3].GetVirtualDeviceConfigSpec().Device.(*types.VirtualNVMEController)
+	g.Expect(ok).To(gomega.BeTrue())
+	disk, backing = diskSpec(4)
+	g.Expect(disk.ControllerKey).To(gomega.Equal(nvme.Key))
+	g.Expect(*backing.ThinProvisioned).To(gomega.BeFalse())
+	g.Expect(*backing.EagerlyScrub).To(gomega.BeTrue())
+
+	// the controller added for the second disk is reused
+	disk, _ = diskSpec(5)
+	g.Expect(disk.ControllerKey).To(gomega.Equal(scsi1.Key))
+	g.Expect(*disk.UnitNumber).NotTo(gomega.Equal(*configSpecs[2].GetVirtualDeviceConfigSpec().Device.GetVirtualDevice().UnitNumber))
+
+	spec.DataDisks = []api.VSphereDataDisk{{Size: 10, ControllerType: "ide"}}
+	_, err = cmd.dataDiskDeviceChanges(context.TODO(), devices, datastoreref)
+	g.Expect(err).To(gomega.HaveOccurred())
+}
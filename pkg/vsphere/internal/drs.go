@@ -0,0 +1,396 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/tags"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
+)
+
+// antiAffinityRuleAttribute is the custom attribute to record the anti-affinity rule of the group on the VM.
+// It is needed to find the VMs of the group as long as the rule does not exist yet.
+const antiAffinityRuleAttribute = "mcm.gardener.cloud/anti-affinity-rule"
+
+// drsLock serializes the read-modify-write cycles of the cluster rules
+var drsLock sync.Mutex
+
+// ruleNameInvalidChars matches the characters of a tag key not used in rule names
+var ruleNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// antiAffinityRuleName returns the name of the anti-affinity rule for the group of the machine.
+// With a group key, the sanitized key is part of the name, as tags of different keys often share the same value.
+func antiAffinityRuleName(spec *api.VsphereProviderSpec) (string, error) {
+	relevantTags, errs := tags.NewRelevantTags(spec.Tags)
+	if relevantTags == nil {
+		return "", fmt.Errorf("anti-affinity: missing relevant tags: %v", errs)
+	}
+	key := spec.AntiAffinity.GroupKey
+	if key == "" {
+		return fmt.Sprintf("mcm-%s-%s", relevantTags.ClusterName(), relevantTags.Role()), nil
+	}
+	group := spec.Tags[key]
+	if group == "" {
+		return "", fmt.Errorf("anti-affinity: group value of tag %q is empty", key)
+	}
+	return fmt.Sprintf("mcm-%s-%s-%s", relevantTags.ClusterName(), ruleNameInvalidChars.ReplaceAllString(key, "-"), group), nil
+}
+
+// addToAntiAffinityRule adds the VM to the anti-affinity rule of its group.
+// As a rule needs at least two VMs, it is created when the second VM of the group is added.
+func addToAntiAffinityRule(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec, cluster *object.ClusterComputeResource, vm types.ManagedObjectReference) error {
+	ruleName, err := antiAffinityRuleName(spec)
+	if err != nil {
+		return err
+	}
+
+	drsLock.Lock()
+	defer drsLock.Unlock()
+
+	manager, err := object.GetCustomFieldsManager(client.Client)
+	if err != nil {
+		return errors.Wrap(err, "GetCustomFieldsManager failed")
+	}
+	if err = setCustomValue(ctx, manager, vm, antiAffinityRuleAttribute, ruleName); err != nil {
+		return err
+	}
+
+	rule, err := findAntiAffinityRule(ctx, cluster, ruleName)
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		for _, ref := range rule.Vm {
+			if ref == vm {
+				return nil
+			}
+		}
+		rule.Vm = append(rule.Vm, vm)
+		klog.V(2).Infof("Adding VM %s to anti-affinity rule %s", vm.Value, ruleName)
+		return reconfigureClusterRule(ctx, cluster, types.ArrayUpdateOperationEdit, rule)
+	}
+
+	var members []types.ManagedObjectReference
+	visitor := func(member *object.VirtualMachine, obj mo.ManagedEntity, field object.CustomFieldDefList) error {
+		for _, cv := range obj.CustomValue {
+			sv, ok := cv.(*types.CustomFieldStringValue)
+			if !ok {
+				continue
+			}
+			if def := field.ByKey(sv.Key); def != nil && def.Name == antiAffinityRuleAttribute && sv.Value == ruleName {
+				members = append(members, member.Reference())
+			}
+		}
+		return nil
+	}
+	if err = visitVirtualMachines(ctx, client, spec, visitor); err != nil {
+		return errors.Wrap(err, "finding VMs of anti-affinity group failed")
+	}
+	if len(members) < 2 {
+		return nil
+	}
+
+	mandatory := spec.AntiAffinity.Mandatory
+	rule = &types.ClusterAntiAffinityRuleSpec{
+		ClusterRuleInfo: types.ClusterRuleInfo{
+			Name:        ruleName,
+			Enabled:     types.NewBool(true),
+			Mandatory:   &mandatory,
+			UserCreated: types.NewBool(true),
+		},
+		Vm: members,
+	}
+	klog.V(2).Infof("Creating anti-affinity rule %s for %d VMs", ruleName, len(members))
+	return reconfigureClusterRule(ctx, cluster, types.ArrayUpdateOperationAdd, rule)
+}
+
+// removeFromAntiAffinityRule removes the VM from the anti-affinity rule of its group.
+// The rule is deleted if less than two VMs are left.
+func removeFromAntiAffinityRule(ctx context.Context, spec *api.VsphereProviderSpec, cluster *object.ClusterComputeResource, vm types.ManagedObjectReference) error {
+	ruleName, err := antiAffinityRuleName(spec)
+	if err != nil {
+		return err
+	}
+
+	drsLock.Lock()
+	defer drsLock.Unlock()
+
+	rule, err := findAntiAffinityRule(ctx, cluster, ruleName)
+	if err != nil || rule == nil {
+		return err
+	}
+	operation, changed := removeFromRuleVMs(rule, vm)
+	if !changed {
+		return nil
+	}
+	if operation == types.ArrayUpdateOperationRemove {
+		klog.V(2).Infof("Deleting anti-affinity rule %s", ruleName)
+	} else {
+		klog.V(2).Infof("Removing VM %s from anti-affinity rule %s", vm.Value, ruleName)
+	}
+	return reconfigureClusterRule(ctx, cluster, operation, rule)
+}
+
+// removeFromRuleVMs removes the VM from the anti-affinity rule. It returns the operation to update the rule,
+// which is deleted if less than two VMs are left, and false if the VM is no member.
+func removeFromRuleVMs(rule *types.ClusterAntiAffinityRuleSpec, vm types.ManagedObjectReference) (types.ArrayUpdateOperation, bool) {
+	var remaining []types.ManagedObjectReference
+	for _, ref := range rule.Vm {
+		if ref != vm {
+			remaining = append(remaining, ref)
+		}
+	}
+	if len(remaining) == len(rule.Vm) {
+		return "", false
+	}
+	if len(remaining) < 2 {
+		return types.ArrayUpdateOperationRemove, true
+	}
+	rule.Vm = remaining
+	return types.ArrayUpdateOperationEdit, true
+}
+
+// hostGroupRuleName returns the name of the VM/Host rule of the VM group
+func hostGroupRuleName(affinity *api.VSphereHostGroupAffinity) string {
+	return fmt.Sprintf("mcm-%s-%s", affinity.VMGroup, affinity.HostGroup)
+}
+
+// addToVMGroup adds the VM to the VM group of the host group affinity.
+// The VM group and the VM/Host rule are created if missing.
+func addToVMGroup(ctx context.Context, affinity *api.VSphereHostGroupAffinity, cluster *object.ClusterComputeResource, vm types.ManagedObjectReference) error {
+	drsLock.Lock()
+	defer drsLock.Unlock()
+
+	config, err := cluster.Configuration(ctx)
+	if err != nil {
+		return errors.Wrap(err, "retrieving cluster configuration failed")
+	}
+	spec, err := addToVMGroupSpec(config, affinity, vm)
+	if err != nil {
+		return errors.Wrapf(err, "cluster %s", cluster.Name())
+	}
+	if spec == nil {
+		return nil
+	}
+	klog.V(2).Infof("Adding VM %s to VM group %s", vm.Value, affinity.VMGroup)
+	return reconfigureCluster(ctx, cluster, spec)
+}
+
+// addToVMGroupSpec returns the cluster reconfiguration to add the VM to the VM group, creating the VM group and
+// the VM/Host rule if missing. It returns nil if the VM is already a member.
+func addToVMGroupSpec(config *types.ClusterConfigInfoEx, affinity *api.VSphereHostGroupAffinity, vm types.ManagedObjectReference) (*types.ClusterConfigSpecEx, error) {
+	var (
+		hostGroup *types.ClusterHostGroup
+		vmGroup   *types.ClusterVmGroup
+	)
+	for _, info := range config.Group {
+		switch group := info.(type) {
+		case *types.ClusterHostGroup:
+			if group.Name == affinity.HostGroup {
+				hostGroup = group
+			}
+		case *types.ClusterVmGroup:
+			if group.Name == affinity.VMGroup {
+				vmGroup = group
+			}
+		}
+	}
+	if hostGroup == nil {
+		return nil, fmt.Errorf("host group %q not found", affinity.HostGroup)
+	}
+
+	spec := &types.ClusterConfigSpecEx{}
+	if vmGroup == nil {
+		klog.V(2).Infof("Creating VM group %s", affinity.VMGroup)
+		spec.GroupSpec = append(spec.GroupSpec, types.ClusterGroupSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info: &types.ClusterVmGroup{
+				ClusterGroupInfo: types.ClusterGroupInfo{Name: affinity.VMGroup},
+				Vm:               []types.ManagedObjectReference{vm},
+			},
+		})
+	} else {
+		for _, ref := range vmGroup.Vm {
+			if ref == vm {
+				return nil, nil
+			}
+		}
+		vmGroup.Vm = append(vmGroup.Vm, vm)
+		spec.GroupSpec = append(spec.GroupSpec, types.ClusterGroupSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationEdit},
+			Info:            vmGroup,
+		})
+	}
+
+	if findVMHostRule(config, affinity) == nil {
+		ruleName := hostGroupRuleName(affinity)
+		klog.V(2).Infof("Creating VM/Host rule %s", ruleName)
+		mandatory := affinity.RuleType == api.HostGroupRuleTypeMust
+		spec.RulesSpec = append(spec.RulesSpec, types.ClusterRuleSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info: &types.ClusterVmHostRuleInfo{
+				ClusterRuleInfo: types.ClusterRuleInfo{
+					Name:        ruleName,
+					Enabled:     types.NewBool(true),
+					Mandatory:   &mandatory,
+					UserCreated: types.NewBool(true),
+				},
+				VmGroupName:         affinity.VMGroup,
+				AffineHostGroupName: affinity.HostGroup,
+			},
+		})
+	}
+	return spec, nil
+}
+
+// removeFromVMGroup removes the VM from the VM group of the host group affinity.
+// The VM/Host rule and the VM group are deleted if the group becomes empty.
+func removeFromVMGroup(ctx context.Context, affinity *api.VSphereHostGroupAffinity, cluster *object.ClusterComputeResource, vm types.ManagedObjectReference) error {
+	drsLock.Lock()
+	defer drsLock.Unlock()
+
+	config, err := cluster.Configuration(ctx)
+	if err != nil {
+		return errors.Wrap(err, "retrieving cluster configuration failed")
+	}
+	for _, spec := range removeFromVMGroupSpecs(config, affinity, vm) {
+		if err = reconfigureCluster(ctx, cluster, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromVMGroupSpecs returns the cluster reconfigurations to remove the VM from the VM group in order.
+// If the group becomes empty, the VM/Host rule is deleted before the VM group.
+func removeFromVMGroupSpecs(config *types.ClusterConfigInfoEx, affinity *api.VSphereHostGroupAffinity, vm types.ManagedObjectReference) []*types.ClusterConfigSpecEx {
+	var vmGroup *types.ClusterVmGroup
+	for _, info := range config.Group {
+		if group, ok := info.(*types.ClusterVmGroup); ok && group.Name == affinity.VMGroup {
+			vmGroup = group
+		}
+	}
+	if vmGroup == nil {
+		return nil
+	}
+	var remaining []types.ManagedObjectReference
+	for _, ref := range vmGroup.Vm {
+		if ref != vm {
+			remaining = append(remaining, ref)
+		}
+	}
+	if len(remaining) == len(vmGroup.Vm) {
+		return nil
+	}
+
+	if len(remaining) > 0 {
+		vmGroup.Vm = remaining
+		klog.V(2).Infof("Removing VM %s from VM group %s", vm.Value, affinity.VMGroup)
+		return []*types.ClusterConfigSpecEx{{
+			GroupSpec: []types.ClusterGroupSpec{{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationEdit},
+				Info:            vmGroup,
+			}},
+		}}
+	}
+
+	// the rule must be removed before its VM group
+	var specs []*types.ClusterConfigSpecEx
+	if rule := findVMHostRule(config, affinity); rule != nil {
+		klog.V(2).Infof("Deleting VM/Host rule %s", rule.Name)
+		specs = append(specs, &types.ClusterConfigSpecEx{
+			RulesSpec: []types.ClusterRuleSpec{{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationRemove, RemoveKey: rule.Key},
+			}},
+		})
+	}
+	klog.V(2).Infof("Deleting VM group %s", affinity.VMGroup)
+	specs = append(specs, &types.ClusterConfigSpecEx{
+		GroupSpec: []types.ClusterGroupSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationRemove, RemoveKey: affinity.VMGroup},
+		}},
+	})
+	return specs
+}
+
+func findVMHostRule(config *types.ClusterConfigInfoEx, affinity *api.VSphereHostGroupAffinity) *types.ClusterVmHostRuleInfo {
+	for _, info := range config.Rule {
+		if rule, ok := info.(*types.ClusterVmHostRuleInfo); ok && rule.VmGroupName == affinity.VMGroup && rule.AffineHostGroupName == affinity.HostGroup {
+			return rule
+		}
+	}
+	return nil
+}
+
+// computeCluster returns the compute cluster of the spec
+func computeCluster(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec) (*object.ClusterComputeResource, error) {
+	ctx = flags.ContextWithPseudoFlagset(ctx, client, spec)
+	clusterFlag, _ := flags.NewClusterFlag(ctx)
+	cluster, err := clusterFlag.Cluster()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing ClusterFlag failed")
+	}
+	return cluster, nil
+}
+
+func findAntiAffinityRule(ctx context.Context, cluster *object.ClusterComputeResource, name string) (*types.ClusterAntiAffinityRuleSpec, error) {
+	config, err := cluster.Configuration(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving cluster configuration failed")
+	}
+	for _, info := range config.Rule {
+		if rule, ok := info.(*types.ClusterAntiAffinityRuleSpec); ok && rule.Name == name {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+func reconfigureClusterRule(ctx context.Context, cluster *object.ClusterComputeResource, operation types.ArrayUpdateOperation, rule types.BaseClusterRuleInfo) error {
+	ruleSpec := types.ClusterRuleSpec{
+		ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: operation},
+		Info:            rule,
+	}
+	if operation == types.ArrayUpdateOperationRemove {
+		ruleSpec.RemoveKey = rule.GetClusterRuleInfo().Key
+		ruleSpec.Info = nil
+	}
+	spec := &types.ClusterConfigSpecEx{RulesSpec: []types.ClusterRuleSpec{ruleSpec}}
+	return errors.Wrapf(reconfigureCluster(ctx, cluster, spec), "rule %s", rule.GetClusterRuleInfo().Name)
+}
+
+func reconfigureCluster(ctx context.Context, cluster *object.ClusterComputeResource, spec *types.ClusterConfigSpecEx) error {
+	task, err := cluster.Reconfigure(ctx, spec, true)
+	if err != nil {
+		return errors.Wrap(err, "starting reconfiguring cluster failed")
+	}
+	if _, err = task.WaitForResult(ctx, nil); err != nil {
+		return errors.Wrap(err, "reconfiguring cluster failed")
+	}
+	return nil
+}
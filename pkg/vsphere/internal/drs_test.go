@@ -0,0 +1,159 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestAntiAffinityRuleName(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &api.VsphereProviderSpec{
+		Tags: map[string]string{
+			api.TagMCMClusterName:        "shoot--foo--bar",
+			api.TagMCMRole:               "node",
+			"worker.gardener.cloud/pool": "pool1",
+		},
+		AntiAffinity: &api.VSphereAntiAffinity{},
+	}
+	name, err := antiAffinityRuleName(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(name).To(gomega.Equal("mcm-shoot--foo--bar-node"))
+
+	spec.AntiAffinity.GroupKey = "worker.gardener.cloud/pool"
+	name, err = antiAffinityRuleName(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(name).To(gomega.Equal("mcm-shoot--foo--bar-worker.gardener.cloud-pool-pool1"))
+
+	// role tags of different keys have the same value
+	spec.Tags["node.kubernetes.io/role-a"] = "1"
+	spec.AntiAffinity.GroupKey = "node.kubernetes.io/role-a"
+	nameA, err := antiAffinityRuleName(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	spec.Tags["node.kubernetes.io/role-b"] = "1"
+	spec.AntiAffinity.GroupKey = "node.kubernetes.io/role-b"
+	nameB, err := antiAffinityRuleName(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(nameA).NotTo(gomega.Equal(nameB))
+
+	spec.AntiAffinity.GroupKey = "missing"
+	_, err = antiAffinityRuleName(spec)
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func vmRef(value string) types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "VirtualMachine", Value: value}
+}
+
+func TestRemoveFromRuleVMs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	rule := &types.ClusterAntiAffinityRuleSpec{Vm: []types.ManagedObjectReference{vmRef("vm-1"), vmRef("vm-2"), vmRef("vm-3")}}
+
+	_, changed := removeFromRuleVMs(rule, vmRef("vm-4"))
+	g.Expect(changed).To(gomega.BeFalse())
+
+	operation, changed := removeFromRuleVMs(rule, vmRef("vm-2"))
+	g.Expect(changed).To(gomega.BeTrue())
+	g.Expect(operation).To(gomega.Equal(types.ArrayUpdateOperationEdit))
+	g.Expect(rule.Vm).To(gomega.Equal([]types.ManagedObjectReference{vmRef("vm-1"), vmRef("vm-3")}))
+
+	// a rule needs at least two VMs
+	operation, changed = removeFromRuleVMs(rule, vmRef("vm-1"))
+	g.Expect(changed).To(gomega.BeTrue())
+	g.Expect(operation).To(gomega.Equal(types.ArrayUpdateOperationRemove))
+}
+
+func TestAddToVMGroupSpec(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	affinity := &api.VSphereHostGroupAffinity{HostGroup: "hosts", VMGroup: "vms", RuleType: api.HostGroupRuleTypeMust}
+	hostGroup := &types.ClusterHostGroup{ClusterGroupInfo: types.ClusterGroupInfo{Name: "hosts"}}
+
+	_, err := addToVMGroupSpec(&types.ClusterConfigInfoEx{}, affinity, vmRef("vm-1"))
+	g.Expect(err).To(gomega.MatchError(`host group "hosts" not found`))
+
+	// the VM group and the rule are created with the first VM
+	config := &types.ClusterConfigInfoEx{Group: []types.BaseClusterGroupInfo{hostGroup}}
+	spec, err := addToVMGroupSpec(config, affinity, vmRef("vm-1"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(spec.GroupSpec).To(gomega.HaveLen(1))
+	g.Expect(spec.GroupSpec[0].Operation).To(gomega.Equal(types.ArrayUpdateOperationAdd))
+	g.Expect(spec.GroupSpec[0].Info).To(gomega.Equal(&types.ClusterVmGroup{
+		ClusterGroupInfo: types.ClusterGroupInfo{Name: "vms"},
+		Vm:               []types.ManagedObjectReference{vmRef("vm-1")},
+	}))
+	g.Expect(spec.RulesSpec).To(gomega.HaveLen(1))
+	g.Expect(spec.RulesSpec[0].Operation).To(gomega.Equal(types.ArrayUpdateOperationAdd))
+	rule := spec.RulesSpec[0].Info.(*types.ClusterVmHostRuleInfo)
+	g.Expect(rule.Name).To(gomega.Equal("mcm-vms-hosts"))
+	g.Expect(*rule.Mandatory).To(gomega.BeTrue())
+	g.Expect(rule.VmGroupName).To(gomega.Equal("vms"))
+	g.Expect(rule.AffineHostGroupName).To(gomega.Equal("hosts"))
+
+	// existing group and rule are edited only
+	vmGroup := &types.ClusterVmGroup{ClusterGroupInfo: types.ClusterGroupInfo{Name: "vms"}, Vm: []types.ManagedObjectReference{vmRef("vm-1")}}
+	config = &types.ClusterConfigInfoEx{
+		Group: []types.BaseClusterGroupInfo{hostGroup, vmGroup},
+		Rule:  []types.BaseClusterRuleInfo{&types.ClusterVmHostRuleInfo{VmGroupName: "vms", AffineHostGroupName: "hosts"}},
+	}
+	spec, err = addToVMGroupSpec(config, affinity, vmRef("vm-2"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(spec.RulesSpec).To(gomega.BeEmpty())
+	g.Expect(spec.GroupSpec).To(gomega.HaveLen(1))
+	g.Expect(spec.GroupSpec[0].Operation).To(gomega.Equal(types.ArrayUpdateOperationEdit))
+	g.Expect(vmGroup.Vm).To(gomega.Equal([]types.ManagedObjectReference{vmRef("vm-1"), vmRef("vm-2")}))
+
+	spec, err = addToVMGroupSpec(config, affinity, vmRef("vm-2"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(spec).To(gomega.BeNil())
+}
+
+func TestRemoveFromVMGroupSpecs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	affinity := &api.VSphereHostGroupAffinity{HostGroup: "hosts", VMGroup: "vms"}
+	vmGroup := &types.ClusterVmGroup{ClusterGroupInfo: types.ClusterGroupInfo{Name: "vms"}, Vm: []types.ManagedObjectReference{vmRef("vm-1"), vmRef("vm-2")}}
+	rule := &types.ClusterVmHostRuleInfo{ClusterRuleInfo: types.ClusterRuleInfo{Key: 7}, VmGroupName: "vms", AffineHostGroupName: "hosts"}
+	config := &types.ClusterConfigInfoEx{
+		Group: []types.BaseClusterGroupInfo{vmGroup},
+		Rule:  []types.BaseClusterRuleInfo{rule},
+	}
+
+	g.Expect(removeFromVMGroupSpecs(&types.ClusterConfigInfoEx{}, affinity, vmRef("vm-1"))).To(gomega.BeEmpty())
+	g.Expect(removeFromVMGroupSpecs(config, affinity, vmRef("vm-3"))).To(gomega.BeEmpty())
+
+	specs := removeFromVMGroupSpecs(config, affinity, vmRef("vm-1"))
+	g.Expect(specs).To(gomega.HaveLen(1))
+	g.Expect(specs[0].GroupSpec[0].Operation).To(gomega.Equal(types.ArrayUpdateOperationEdit))
+	g.Expect(vmGroup.Vm).To(gomega.Equal([]types.ManagedObjectReference{vmRef("vm-2")}))
+
+	// the rule is deleted before the empty group
+	specs = removeFromVMGroupSpecs(config, affinity, vmRef("vm-2"))
+	g.Expect(specs).To(gomega.HaveLen(2))
+	g.Expect(specs[0].RulesSpec).To(gomega.Equal([]types.ClusterRuleSpec{{
+		ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationRemove, RemoveKey: int32(7)},
+	}}))
+	g.Expect(specs[1].GroupSpec).To(gomega.Equal([]types.ClusterGroupSpec{{
+		ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationRemove, RemoveKey: "vms"},
+	}}))
+}
@@ -54,6 +54,18 @@ func NewNetworkFlag(ctx context.Context) (*NetworkFlag, context.Context) {
 	return v, ctx
 }
 
+// NewCustomNetworkFlag creates and returns a new NetworkFlag for the given network interface
+// without trying to retrieve an existing one from the specified context.
+func NewCustomNetworkFlag(ctx context.Context, name, switchUUID, adapter string) (*NetworkFlag, context.Context) {
+	v := &NetworkFlag{adapter: adapter}
+	_ = v.Set(name)
+	if switchUUID != "" {
+		_ = v.SetSwitchUUID(switchUUID)
+	}
+	v.DatacenterFlag, ctx = NewDatacenterFlag(ctx)
+	return v, ctx
+}
+
 func (flag *NetworkFlag) String() string {
 	return flag.name
 }
@@ -69,6 +81,20 @@ func (flag *NetworkFlag) SetSwitchUUID(uuid string) error {
 	return nil
 }
 
+func (flag *NetworkFlag) SetAdapter(adapter string) error {
+	flag.adapter = adapter
+	return nil
+}
+
+func (flag *NetworkFlag) Adapter() string {
+	return flag.adapter
+}
+
+// SetNetwork sets the network reference instead of looking it up by name
+func (flag *NetworkFlag) SetNetwork(net object.NetworkReference) {
+	flag.net = net
+}
+
 func (flag *NetworkFlag) IsSet() bool {
 	return flag.isset
 }
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// machineIdentity describes the machine and its placement for agents running in the guest.
+type machineIdentity struct {
+	machineName    string
+	providerID     string
+	region         string
+	datacenter     string
+	computeCluster string
+	host           string
+	datastore      string
+}
+
+// extraConfig returns the guestinfo keys of the identity, empty values are omitted.
+func (id *machineIdentity) extraConfig() map[string]string {
+	extraConfig := map[string]string{}
+	for name, value := range map[string]string{
+		"machine-name":    id.machineName,
+		"provider-id":     id.providerID,
+		"region":          id.region,
+		"datacenter":      id.datacenter,
+		"compute-cluster": id.computeCluster,
+		"host":            id.host,
+		"datastore":       id.datastore,
+	} {
+		if value != "" {
+			extraConfig[api.GuestInfoIdentityPrefix+name] = value
+		}
+	}
+	return extraConfig
+}
+
+// machineIdentity collects the identity of the cloned VM. The provider ID is derived from the
+// VM UUID like in CreateMachine, host and datastore are the ones chosen by the placement.
+func (cmd *clone) machineIdentity(ctx context.Context, vm *object.VirtualMachine) (*machineIdentity, error) {
+	var props mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.uuid", "config.files.vmPathName", "runtime.host"}, &props); err != nil {
+		return nil, errors.Wrap(err, "retrieving VM properties failed")
+	}
+
+	id := &machineIdentity{
+		machineName: cmd.name,
+		providerID:  encodeProviderID(cmd.spec.Region, props.Config.Uuid),
+		region:      cmd.spec.Region,
+	}
+	if cmd.Datacenter != nil {
+		id.datacenter = cmd.Datacenter.Name()
+	}
+
+	var dsPath object.DatastorePath
+	if dsPath.FromString(props.Config.Files.VmPathName) {
+		id.datastore = dsPath.Datastore
+	}
+
+	if props.Runtime.Host != nil {
+		pc := property.DefaultCollector(cmd.Client)
+		var host mo.HostSystem
+		if err := pc.RetrieveOne(ctx, *props.Runtime.Host, []string{"name", "parent"}, &host); err != nil {
+			return nil, errors.Wrap(err, "retrieving host properties failed")
+		}
+		id.host = host.Name
+		if host.Parent != nil && host.Parent.Type == "ClusterComputeResource" {
+			var cluster mo.ManagedEntity
+			if err := pc.RetrieveOne(ctx, *host.Parent, []string{"name"}, &cluster); err != nil {
+				return nil, errors.Wrap(err, "retrieving compute cluster properties failed")
+			}
+			id.computeCluster = cluster.Name
+		}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestMachineIdentityExtraConfig(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	id := &machineIdentity{
+		machineName: "machine1",
+		providerID:  encodeProviderID("region1", "4211a2d0-1b5e-4a5d-9b0e-3b1f0c5e7a01"),
+		region:      "region1",
+		datacenter:  "dc1",
+		host:        "esx1.example.com",
+		datastore:   "ds1",
+	}
+	g.Expect(id.extraConfig()).To(gomega.Equal(map[string]string{
+		"guestinfo.mcm.machine-name": "machine1",
+		"guestinfo.mcm.provider-id":  "vsphere://region1/4211a2d0-1b5e-4a5d-9b0e-3b1f0c5e7a01",
+		"guestinfo.mcm.region":       "region1",
+		"guestinfo.mcm.datacenter":   "dc1",
+		"guestinfo.mcm.host":         "esx1.example.com",
+		"guestinfo.mcm.datastore":    "ds1",
+	}))
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// Ignition configs are generated with the typed structs below, containing only the fields needed.
+// Spec 2.x: https://coreos.github.io/ignition/configuration-v2_3/
+// Spec 3.x: https://coreos.github.io/ignition/configuration-v3_4/
+
+type ignitionConfigReference struct {
+	// Compression is supported since spec 3.1.0
+	Compression string `json:"compression,omitempty"`
+	Source      string `json:"source"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users"`
+}
+
+type ignitionFileContents struct {
+	Compression string `json:"compression,omitempty"`
+	Source      string `json:"source"`
+}
+
+type ignitionV2 struct {
+	Ignition struct {
+		Config struct {
+			Append []ignitionConfigReference `json:"append,omitempty"`
+		} `json:"config"`
+		Timeouts struct{} `json:"timeouts"`
+		Version  string   `json:"version"`
+	} `json:"ignition"`
+	Networkd struct {
+		Units []networkdUnit `json:"units"`
+	} `json:"networkd"`
+	Passwd  ignitionPasswd `json:"passwd"`
+	Storage struct {
+		Directories []ignitionV2Node `json:"directories,omitempty"`
+		Files       []ignitionV2File `json:"files,omitempty"`
+	} `json:"storage"`
+	Systemd struct{} `json:"systemd"`
+}
+
+type ignitionV2Node struct {
+	Filesystem string `json:"filesystem"`
+	Path       string `json:"path"`
+	Mode       int    `json:"mode"`
+}
+
+type ignitionV2File struct {
+	Filesystem string               `json:"filesystem"`
+	Path       string               `json:"path"`
+	Contents   ignitionFileContents `json:"contents"`
+	Mode       int                  `json:"mode"`
+}
+
+type ignitionV3 struct {
+	Ignition struct {
+		Config struct {
+			Merge []ignitionConfigReference `json:"merge,omitempty"`
+		} `json:"config"`
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  ignitionPasswd `json:"passwd"`
+	Storage struct {
+		Directories []ignitionV3Node `json:"directories,omitempty"`
+		Files       []ignitionV3File `json:"files,omitempty"`
+	} `json:"storage"`
+}
+
+type ignitionV3Node struct {
+	Path string `json:"path"`
+	Mode int    `json:"mode"`
+}
+
+type ignitionV3File struct {
+	Path      string               `json:"path"`
+	Contents  ignitionFileContents `json:"contents"`
+	Mode      int                  `json:"mode"`
+	Overwrite bool                 `json:"overwrite"`
+}
+
+const (
+	modeDirectory = 0755
+	modeFile      = 0644
+)
+
+// ignitionFile generates the Ignition config for the given version.
+// If the user data is an Ignition config itself, it is merged into the generated config,
+// otherwise it is stored as file in the install path.
+func ignitionFile(config *ignitionConfig) (string, error) {
+	userdataVersion, isIgnition := ignitionVersionOf(config.Userdata)
+	version := config.Version
+	if version == "" {
+		version = api.DefaultIgnitionVersion
+		if isIgnition {
+			version = userdataVersion
+		}
+	}
+	if !api.IsSupportedIgnitionVersion(version) {
+		return "", fmt.Errorf("unsupported Ignition version %q", version)
+	}
+	if isIgnition && majorVersion(userdataVersion) != majorVersion(version) {
+		return "", fmt.Errorf("user data with Ignition version %s cannot be merged into Ignition version %s", userdataVersion, version)
+	}
+
+	units := config.NetworkdUnits
+	if len(units) == 0 {
+		units = defaultNetworkdUnits
+	}
+	user := ignitionUser{Name: "core", PasswordHash: config.PasswdHash, SSHAuthorizedKeys: config.SSHKeys}
+	if user.SSHAuthorizedKeys == nil {
+		user.SSHAuthorizedKeys = []string{}
+	}
+	userdataContents, err := userdataFileContents(config.Userdata)
+	if err != nil {
+		return "", errors.Wrap(err, "Creating ignition file failed")
+	}
+	plainUserdataSource := "data:text/plain;charset=utf-8;base64," + base64.StdEncoding.EncodeToString([]byte(config.Userdata))
+	hostnameSource := "data:," + url.PathEscape(config.Hostname)
+
+	var content []byte
+	if majorVersion(version) == "2" {
+		ign := &ignitionV2{}
+		ign.Ignition.Version = version
+		ign.Networkd.Units = units
+		ign.Passwd.Users = []ignitionUser{user}
+		ign.Storage.Files = []ignitionV2File{{Filesystem: "root", Path: "/etc/hostname", Contents: ignitionFileContents{Source: hostnameSource}, Mode: modeFile}}
+		if isIgnition {
+			// no compression of config references in spec 2.x
+			ign.Ignition.Config.Append = []ignitionConfigReference{{Source: plainUserdataSource}}
+		} else {
+			ign.Storage.Directories = []ignitionV2Node{{Filesystem: "root", Path: config.InstallPath, Mode: modeDirectory}}
+			ign.Storage.Files = append(ign.Storage.Files, ignitionV2File{Filesystem: "root", Path: config.InstallPath + "/user_data", Contents: userdataContents, Mode: modeFile})
+		}
+		content, err = json.Marshal(ign)
+	} else {
+		ign := &ignitionV3{}
+		ign.Ignition.Version = version
+		ign.Passwd.Users = []ignitionUser{user}
+		ign.Storage.Files = []ignitionV3File{{Path: "/etc/hostname", Contents: ignitionFileContents{Source: hostnameSource}, Mode: modeFile, Overwrite: true}}
+		// there is no networkd section in spec 3.x, the units are written as files
+		for _, unit := range units {
+			ign.Storage.Files = append(ign.Storage.Files, ignitionV3File{
+				Path:      "/etc/systemd/network/" + unit.Name,
+				Contents:  ignitionFileContents{Source: "data:," + url.PathEscape(unit.Contents)},
+				Mode:      modeFile,
+				Overwrite: true,
+			})
+		}
+		if isIgnition {
+			reference := ignitionConfigReference{Source: plainUserdataSource}
+			if version != "3.0.0" {
+				reference = ignitionConfigReference{Compression: userdataContents.Compression, Source: userdataContents.Source}
+			}
+			ign.Ignition.Config.Merge = []ignitionConfigReference{reference}
+		} else {
+			ign.Storage.Directories = []ignitionV3Node{{Path: config.InstallPath, Mode: modeDirectory}}
+			ign.Storage.Files = append(ign.Storage.Files, ignitionV3File{Path: config.InstallPath + "/user_data", Contents: userdataContents, Mode: modeFile, Overwrite: true})
+		}
+		content, err = json.Marshal(ign)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Creating ignition file failed")
+	}
+	return string(content), nil
+}
+
+// userdataFileContents returns the user data as data URL, compressed with gzip if it gets smaller
+func userdataFileContents(userdata string) (ignitionFileContents, error) {
+	compressed, err := gzipData([]byte(userdata))
+	if err != nil {
+		return ignitionFileContents{}, err
+	}
+	if len(compressed) < len(userdata) {
+		return ignitionFileContents{Compression: "gzip", Source: "data:;base64," + base64.StdEncoding.EncodeToString(compressed)}, nil
+	}
+	return ignitionFileContents{Source: "data:text/plain;charset=utf-8;base64," + base64.StdEncoding.EncodeToString([]byte(userdata))}, nil
+}
+
+// ignitionVersionOf returns the spec version if the user data is an Ignition config
+func ignitionVersionOf(userdata string) (string, bool) {
+	trimmed := strings.TrimSpace(userdata)
+	if !strings.HasPrefix(trimmed, "{") {
+		return "", false
+	}
+	var doc struct {
+		Ignition *struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal([]byte(trimmed), &doc); err != nil || doc.Ignition == nil || doc.Ignition.Version == "" {
+		return "", false
+	}
+	return doc.Ignition.Version, true
+}
+
+func majorVersion(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
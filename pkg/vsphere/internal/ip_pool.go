@@ -0,0 +1,208 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/ippool"
+)
+
+// ipAllocationAttribute is the custom attribute to record the IP addresses allocated from IP pools on the VM.
+// The value has the form `<nic index>=<address>,...`, e.g. `0=10.0.0.10/24`
+const ipAllocationAttribute = "mcm.gardener.cloud/ip-allocation"
+
+// ipAllocator allocates IP addresses from the IP pools of the network interfaces.
+// Addresses in use are found by scanning the allocation attribute of the VMs. Addresses allocated
+// for machines still being created are kept as pending to avoid collisions between concurrent creates.
+type ipAllocator struct {
+	lock    sync.Mutex
+	pending map[string][]netip.Addr
+}
+
+var defaultIPAllocator = &ipAllocator{pending: map[string][]netip.Addr{}}
+
+// hasIPPools returns true if any network interface allocates its address from an IP pool
+func hasIPPools(spec *api.VsphereProviderSpec) bool {
+	for _, nic := range spec.Networks {
+		if nic.IPPool != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate allocates an address for every network interface with an IP pool and sets it as IP address of the
+// network interface. The addresses stay pending until released.
+// Returns the value of the allocation attribute to be recorded on the VM.
+func (a *ipAllocator) allocate(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec, machineName string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	used, err := a.usedAddresses(ctx, client, spec)
+	if err != nil {
+		return "", errors.Wrap(err, "scanning allocated IP addresses failed")
+	}
+	return a.allocateFrom(used, spec, machineName)
+}
+
+// allocateFrom allocates the addresses skipping the used ones. The caller must hold the lock.
+func (a *ipAllocator) allocateFrom(used map[netip.Addr]bool, spec *api.VsphereProviderSpec, machineName string) (string, error) {
+	var (
+		allocated []netip.Addr
+		entries   []string
+	)
+	for i := range spec.Networks {
+		nic := &spec.Networks[i]
+		if nic.IPPool == nil {
+			continue
+		}
+		pool, err := ippool.NewPool(nic.IPPool)
+		if err != nil {
+			return "", errors.Wrapf(err, "networks[%d]: invalid IP pool", i)
+		}
+		address, err := pool.Allocate(used)
+		if err != nil {
+			return "", errors.Wrapf(err, "networks[%d]: allocating IP address failed", i)
+		}
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return "", errors.Wrapf(err, "networks[%d]: allocating IP address failed", i)
+		}
+		used[prefix.Addr()] = true
+		allocated = append(allocated, prefix.Addr())
+		nic.IPAddresses = []string{address}
+		entries = append(entries, fmt.Sprintf("%d=%s", i, address))
+	}
+
+	a.pending[machineName] = allocated
+	klog.V(2).Infof("Allocated IP addresses %s for machine %q", strings.Join(entries, ","), machineName)
+	return strings.Join(entries, ","), nil
+}
+
+// release drops the pending addresses of the machine.
+func (a *ipAllocator) release(machineName string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.pending, machineName)
+}
+
+// recordIPAllocation records the IP allocation on the VM of the machine. If that fails, the VM is destroyed,
+// as the next create would get the same addresses otherwise once the pending addresses are released.
+func recordIPAllocation(machineName string, record, destroy func() error) error {
+	if err := record(); err != nil {
+		if destroyErr := destroy(); destroyErr != nil {
+			klog.Errorf("Destroying VM %s after failed recording of the IP allocation failed: %s", machineName, destroyErr)
+		}
+		return errors.Wrap(err, "Record IP allocation")
+	}
+	return nil
+}
+
+func (a *ipAllocator) usedAddresses(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec) (map[netip.Addr]bool, error) {
+	used := map[netip.Addr]bool{}
+	for _, addrs := range a.pending {
+		for _, addr := range addrs {
+			used[addr] = true
+		}
+	}
+
+	visitor := func(vm *object.VirtualMachine, obj mo.ManagedEntity, field object.CustomFieldDefList) error {
+		for _, cv := range obj.CustomValue {
+			sv, ok := cv.(*types.CustomFieldStringValue)
+			if !ok {
+				continue
+			}
+			if def := field.ByKey(sv.Key); def == nil || def.Name != ipAllocationAttribute {
+				continue
+			}
+			for _, addr := range parseIPAllocation(sv.Value) {
+				used[addr] = true
+			}
+		}
+		return nil
+	}
+	if err := visitVirtualMachines(ctx, client, spec, visitor); err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+// parseIPAllocation returns the addresses of the allocation attribute value ordered by network interface index.
+func parseIPAllocation(value string) []netip.Addr {
+	type entry struct {
+		index int
+		addr  netip.Addr
+	}
+	var entries []entry
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		index, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(parts[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{index: index, addr: prefix.Addr()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].index < entries[j].index })
+
+	addrs := make([]netip.Addr, len(entries))
+	for i, e := range entries {
+		addrs[i] = e.addr
+	}
+	return addrs
+}
+
+// setCustomValue sets a custom attribute on the managed object, the attribute is created if needed
+func setCustomValue(ctx context.Context, manager *object.CustomFieldsManager, ref types.ManagedObjectReference, name, value string) error {
+	key, err := manager.FindKey(ctx, name)
+	if err != nil {
+		if err != object.ErrKeyNameNotFound {
+			return errors.Wrapf(err, "FindKey failed for %s", name)
+		}
+		fieldDef, err := manager.Add(ctx, name, "VirtualMachine", nil, nil)
+		if err != nil {
+			return errors.Wrapf(err, "Add key %s failed", name)
+		}
+		key = fieldDef.Key
+	}
+	if err = manager.Set(ctx, ref, key, value); err != nil {
+		return errors.Wrapf(err, "Set custom value %s(%d) failed", name, key)
+	}
+	return nil
+}
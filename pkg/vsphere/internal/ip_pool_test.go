@@ -0,0 +1,86 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/onsi/gomega"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestIPAllocatorAllocate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	pool := &api.VSphereIPPool{
+		Ranges:       []string{"10.0.0.10-10.0.0.14"},
+		Excludes:     []string{"10.0.0.10", "10.0.0.12"},
+		PrefixLength: 24,
+	}
+	spec := &api.VsphereProviderSpec{
+		Networks: []api.VSphereNetworkInterface{
+			{Name: "dhcp"},
+			{Name: "pool1", IPPool: pool},
+			{Name: "pool2", IPPool: pool},
+		},
+	}
+	allocator := &ipAllocator{pending: map[string][]netip.Addr{}}
+	used := map[netip.Addr]bool{netip.MustParseAddr("10.0.0.11"): true}
+
+	allocation, err := allocator.allocateFrom(used, spec, "machine1")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(allocation).To(gomega.Equal("1=10.0.0.13/24,2=10.0.0.14/24"))
+	g.Expect(spec.Networks[0].IPAddresses).To(gomega.BeEmpty())
+	g.Expect(spec.Networks[1].IPAddresses).To(gomega.Equal([]string{"10.0.0.13/24"}))
+	g.Expect(spec.Networks[2].IPAddresses).To(gomega.Equal([]string{"10.0.0.14/24"}))
+	g.Expect(allocator.pending["machine1"]).To(gomega.Equal([]netip.Addr{netip.MustParseAddr("10.0.0.13"), netip.MustParseAddr("10.0.0.14")}))
+	g.Expect(parseIPAllocation(allocation)).To(gomega.Equal(allocator.pending["machine1"]))
+
+	// all addresses are excluded, used or allocated
+	_, err = allocator.allocateFrom(used, &api.VsphereProviderSpec{
+		Networks: []api.VSphereNetworkInterface{{Name: "pool1", IPPool: pool}},
+	}, "machine2")
+	g.Expect(err).To(gomega.MatchError("networks[0]: allocating IP address failed: IP pool exhausted"))
+	g.Expect(allocator.pending).NotTo(gomega.HaveKey("machine2"))
+
+	allocator.release("machine1")
+	g.Expect(allocator.pending).To(gomega.BeEmpty())
+}
+
+func TestRecordIPAllocation(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	destroyed := false
+	destroy := func() error {
+		destroyed = true
+		return nil
+	}
+
+	err := recordIPAllocation("machine1", func() error { return nil }, destroy)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(destroyed).To(gomega.BeFalse())
+
+	// the VM must not keep addresses which are not recorded
+	err = recordIPAllocation("machine1", func() error { return fmt.Errorf("no permission") }, destroy)
+	g.Expect(err).To(gomega.MatchError("Record IP allocation: no permission"))
+	g.Expect(destroyed).To(gomega.BeTrue())
+
+	err = recordIPAllocation("machine1", func() error { return fmt.Errorf("no permission") }, func() error { return fmt.Errorf("busy") })
+	g.Expect(err).To(gomega.MatchError("Record IP allocation: no permission"))
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+// Package iso9660 writes small ISO 9660 images with Joliet extension containing files in the root directory,
+// as needed for cloud-init NoCloud seed images.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+	// the first 16 sectors are the unused system area
+	systemAreaSectors = 16
+
+	// sector layout: volume descriptors, path tables, root directories, file data
+	primaryDescriptorSector       = 16
+	supplementaryDescriptorSector = 17
+	terminatorSector              = 18
+	primaryLPathTableSector       = 19
+	primaryMPathTableSector       = 20
+	jolietLPathTableSector        = 21
+	jolietMPathTableSector        = 22
+	primaryRootSector             = 23
+	jolietRootSector              = 24
+	firstDataSector               = 25
+)
+
+// File is a file in the root directory of the image
+type File struct {
+	Name    string
+	Content []byte
+}
+
+type directoryEntry struct {
+	identifier []byte
+	sector     uint32
+	size       uint32
+	directory  bool
+}
+
+// Create returns the image with the volume identifier and the files in the root directory.
+// The Joliet names are the file names, the ISO 9660 names are derived in 8.3 format.
+func Create(volumeID string, files []File) ([]byte, error) {
+	var (
+		primaryEntries []directoryEntry
+		jolietEntries  []directoryEntry
+		fileSectors    []uint32
+		primaryNames   = map[string]bool{}
+		jolietNames    = map[string]bool{}
+	)
+	sector := uint32(firstDataSector)
+	for _, file := range files {
+		if file.Name == "" || len(file.Name) > 64 || strings.ContainsAny(file.Name, "/\\*:;?") {
+			return nil, fmt.Errorf("invalid file name %q", file.Name)
+		}
+		primaryName := primaryIdentifier(file.Name)
+		if primaryNames[primaryName] || jolietNames[file.Name] {
+			return nil, fmt.Errorf("duplicate file name %q", file.Name)
+		}
+		primaryNames[primaryName] = true
+		jolietNames[file.Name] = true
+
+		size := uint32(len(file.Content))
+		primaryEntries = append(primaryEntries, directoryEntry{identifier: []byte(primaryName), sector: sector, size: size})
+		jolietEntries = append(jolietEntries, directoryEntry{identifier: ucs2(file.Name), sector: sector, size: size})
+		fileSectors = append(fileSectors, sector)
+		sector += sectors(size)
+	}
+	totalSectors := sector
+
+	sortEntries(primaryEntries)
+	sortEntries(jolietEntries)
+	primaryRoot, err := directory(primaryRootSector, primaryEntries)
+	if err != nil {
+		return nil, err
+	}
+	jolietRoot, err := directory(jolietRootSector, jolietEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	image := make([]byte, int(totalSectors)*sectorSize)
+	copy(image[primaryDescriptorSector*sectorSize:], volumeDescriptor(1, volumeID, totalSectors))
+	copy(image[supplementaryDescriptorSector*sectorSize:], volumeDescriptor(2, volumeID, totalSectors))
+	copy(image[terminatorSector*sectorSize:], []byte{255, 'C', 'D', '0', '0', '1', 1})
+	copy(image[primaryLPathTableSector*sectorSize:], pathTable(binary.LittleEndian, primaryRootSector))
+	copy(image[primaryMPathTableSector*sectorSize:], pathTable(binary.BigEndian, primaryRootSector))
+	copy(image[jolietLPathTableSector*sectorSize:], pathTable(binary.LittleEndian, jolietRootSector))
+	copy(image[jolietMPathTableSector*sectorSize:], pathTable(binary.BigEndian, jolietRootSector))
+	copy(image[primaryRootSector*sectorSize:], primaryRoot)
+	copy(image[jolietRootSector*sectorSize:], jolietRoot)
+	for i, file := range files {
+		copy(image[int(fileSectors[i])*sectorSize:], file.Content)
+	}
+	return image, nil
+}
+
+func sectors(size uint32) uint32 {
+	return (size + sectorSize - 1) / sectorSize
+}
+
+// primaryIdentifier returns the ISO 9660 level 1 file identifier, e.g. USER_DAT.;1 for user-data
+func primaryIdentifier(name string) string {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	return dCharacters(base, 8) + "." + dCharacters(ext, 3) + ";1"
+}
+
+func dCharacters(s string, max int) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(s) {
+		if b.Len() == max {
+			break
+		}
+		if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// ucs2 encodes the string as UCS-2 big endian as used by Joliet
+func ucs2(s string) []byte {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		_ = binary.Write(&buf, binary.BigEndian, c)
+	}
+	return buf.Bytes()
+}
+
+func sortEntries(entries []directoryEntry) {
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].identifier, entries[j].identifier) < 0 })
+}
+
+// directory returns the root directory with the entries for itself and its parent
+func directory(sector uint32, entries []directoryEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	self := directoryEntry{identifier: []byte{0}, sector: sector, size: sectorSize, directory: true}
+	buf.Write(directoryRecord(self))
+	parent := directoryEntry{identifier: []byte{1}, sector: sector, size: sectorSize, directory: true}
+	buf.Write(directoryRecord(parent))
+	for _, entry := range entries {
+		buf.Write(directoryRecord(entry))
+	}
+	if buf.Len() > sectorSize {
+		return nil, fmt.Errorf("too many files")
+	}
+	return buf.Bytes(), nil
+}
+
+func directoryRecord(entry directoryEntry) []byte {
+	length := 33 + len(entry.identifier)
+	if length%2 != 0 {
+		length++
+	}
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothUint32(record[2:], entry.sector)
+	putBothUint32(record[10:], entry.size)
+	// recording date 18-24 is left unspecified
+	if entry.directory {
+		record[25] = 2
+	}
+	putBothUint16(record[28:], 1)
+	record[32] = byte(len(entry.identifier))
+	copy(record[33:], entry.identifier)
+	return record
+}
+
+// pathTable returns the path table containing only the root directory
+func pathTable(order binary.ByteOrder, rootSector uint32) []byte {
+	table := make([]byte, 10)
+	table[0] = 1
+	order.PutUint32(table[2:], rootSector)
+	order.PutUint16(table[6:], 1)
+	return table
+}
+
+// volumeDescriptor returns the primary (type 1) or the Joliet supplementary (type 2) volume descriptor
+func volumeDescriptor(descriptorType byte, volumeID string, totalSectors uint32) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = descriptorType
+	copy(d[1:6], "CD001")
+	d[6] = 1
+
+	joliet := descriptorType == 2
+	text := func(field []byte, value string) {
+		if joliet {
+			// padded with UCS-2 spaces
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, ucs2(value))
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, value)
+	}
+
+	text(d[8:40], "")
+	if joliet {
+		text(d[40:72], volumeID)
+	} else {
+		text(d[40:72], dCharacters(volumeID, 32))
+	}
+	putBothUint32(d[80:], totalSectors)
+	if joliet {
+		// escape sequence for UCS-2 level 3
+		copy(d[88:91], "%/E")
+	}
+	putBothUint16(d[120:], 1)
+	putBothUint16(d[124:], 1)
+	putBothUint16(d[128:], sectorSize)
+	putBothUint32(d[132:], 10)
+	lPathTable, mPathTable, rootSector := uint32(primaryLPathTableSector), uint32(primaryMPathTableSector), uint32(primaryRootSector)
+	if joliet {
+		lPathTable, mPathTable, rootSector = jolietLPathTableSector, jolietMPathTableSector, jolietRootSector
+	}
+	binary.LittleEndian.PutUint32(d[140:], lPathTable)
+	binary.BigEndian.PutUint32(d[148:], mPathTable)
+	copy(d[156:190], directoryRecord(directoryEntry{identifier: []byte{0}, sector: rootSector, size: sectorSize, directory: true}))
+	text(d[190:318], "")
+	text(d[318:446], "")
+	text(d[446:574], "")
+	text(d[574:702], "")
+	text(d[702:739], "")
+	text(d[739:776], "")
+	text(d[776:813], "")
+	// creation, modification, expiration and effective dates are unspecified
+	for _, offset := range []int{813, 830, 847, 864} {
+		copy(d[offset:offset+16], "0000000000000000")
+	}
+	d[881] = 1
+	return d
+}
+
+func putBothUint32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func putBothUint16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
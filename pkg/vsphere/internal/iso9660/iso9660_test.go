@@ -0,0 +1,78 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package iso9660
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestPrimaryIdentifier(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(primaryIdentifier("user-data")).To(gomega.Equal("USER_DAT.;1"))
+	g.Expect(primaryIdentifier("network-config")).To(gomega.Equal("NETWORK_.;1"))
+	g.Expect(primaryIdentifier("seed.iso")).To(gomega.Equal("SEED.ISO;1"))
+}
+
+func TestCreate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	image, err := Create("cidata", []File{
+		{Name: "user-data", Content: []byte("#cloud-config\n")},
+		{Name: "meta-data", Content: make([]byte, 3000)},
+		{Name: "network-config", Content: []byte("version: 2\n")},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(len(image) % sectorSize).To(gomega.Equal(0))
+
+	primary := image[primaryDescriptorSector*sectorSize:]
+	g.Expect(string(primary[1:6])).To(gomega.Equal("CD001"))
+	g.Expect(string(primary[40:46])).To(gomega.Equal("CIDATA"))
+	g.Expect(binary.LittleEndian.Uint32(primary[80:])).To(gomega.Equal(uint32(len(image) / sectorSize)))
+	joliet := image[supplementaryDescriptorSector*sectorSize:]
+	g.Expect(joliet[0]).To(gomega.Equal(byte(2)))
+	g.Expect(joliet[40:52]).To(gomega.Equal(ucs2("cidata")))
+
+	files := readRoot(image, jolietRootSector)
+	g.Expect(files).To(gomega.HaveLen(3))
+	g.Expect(files[string(ucs2("user-data"))]).To(gomega.Equal([]byte("#cloud-config\n")))
+	g.Expect(files[string(ucs2("meta-data"))]).To(gomega.HaveLen(3000))
+	g.Expect(files[string(ucs2("network-config"))]).To(gomega.Equal([]byte("version: 2\n")))
+	g.Expect(readRoot(image, primaryRootSector)).To(gomega.HaveKey("USER_DAT.;1"))
+
+	_, err = Create("cidata", []File{{Name: "user-data"}, {Name: "user-data"}})
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+// readRoot returns the contents of the files in the root directory by identifier
+func readRoot(image []byte, sector int) map[string][]byte {
+	files := map[string][]byte{}
+	dir := image[sector*sectorSize : (sector+1)*sectorSize]
+	for offset := 0; offset < len(dir) && dir[offset] > 0; offset += int(dir[offset]) {
+		record := dir[offset:]
+		if record[25]&2 != 0 {
+			continue
+		}
+		location := binary.LittleEndian.Uint32(record[2:])
+		size := binary.LittleEndian.Uint32(record[10:])
+		identifier := string(record[33 : 33+int(record[32])])
+		files[identifier] = image[int(location)*sectorSize : int(location)*sectorSize+int(size)]
+	}
+	return files
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/library"
+	"github.com/vmware/govmomi/vapi/vcenter"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
+)
+
+// deployLibraryItem deploys the content library item of the templateVM.
+// Items of type OVF and VM template are supported. The network cards, system disk, data disks and
+// customization are applied to the deployed VM afterwards, as the deploy calls do not support them.
+func (cmd *clone) deployLibraryItem(ctx context.Context) (*object.VirtualMachine, error) {
+	if cmd.RestClient == nil {
+		return nil, fmt.Errorf("content library: missing vAPI client")
+	}
+
+	item, err := cmd.findLibraryItem(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	datastoreref, err := cmd.libraryDatastore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.checkVMXExists(ctx, datastoreref); err != nil {
+		return nil, err
+	}
+
+	folderID := cmd.Folder.Reference().Value
+	poolID := cmd.ResourcePool.Reference().Value
+	hostID := ""
+	if cmd.HostSystem != nil {
+		hostID = cmd.HostSystem.Reference().Value
+	}
+
+	klog.Infof("Deploying library item %s (%s) to %s...", cmd.LibraryItem, item.Type, cmd.name)
+
+	manager := vcenter.NewManager(cmd.RestClient)
+	var ref *types.ManagedObjectReference
+	switch item.Type {
+	case library.ItemTypeOVF:
+		ref, err = manager.DeployLibraryItem(ctx, item.ID, vcenter.Deploy{
+			DeploymentSpec: vcenter.DeploymentSpec{
+				Name:               cmd.name,
+				DefaultDatastoreID: datastoreref.Value,
+				StorageProfileID:   cmd.profileID,
+				AcceptAllEULA:      true,
+			},
+			Target: vcenter.Target{
+				ResourcePoolID: poolID,
+				HostID:         hostID,
+				FolderID:       folderID,
+			},
+		})
+	case library.ItemTypeVMTX:
+		storage := &vcenter.DiskStorage{Datastore: datastoreref.Value}
+		if cmd.profileID != "" {
+			storage.StoragePolicy = &vcenter.StoragePolicy{Policy: cmd.profileID, Type: "USE_SPECIFIED_POLICY"}
+		}
+		ref, err = manager.DeployTemplateLibraryItem(ctx, item.ID, vcenter.DeployTemplate{
+			Name: cmd.name,
+			Placement: &vcenter.Placement{
+				ResourcePool: poolID,
+				Host:         hostID,
+				Folder:       folderID,
+			},
+			DiskStorage:   storage,
+			VMHomeStorage: storage,
+			PoweredOn:     false,
+		})
+	default:
+		return nil, fmt.Errorf("content library: unsupported type %q of library item %s", item.Type, cmd.LibraryItem)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "deploying library item %s failed", cmd.LibraryItem)
+	}
+	vm := object.NewVirtualMachine(cmd.Client, *ref)
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing VM devices failed")
+	}
+	deviceChanges, nicCards, err := cmd.networkDeviceChanges(devices)
+	if err != nil {
+		return nil, err
+	}
+	cmd.nicCards = nicCards
+	if cmd.spec.SystemDisk != nil {
+		diskSpec, err := systemDiskDeviceChange(devices, cmd.spec.SystemDisk)
+		if err != nil {
+			return nil, err
+		}
+		deviceChanges = append(deviceChanges, diskSpec)
+	}
+	if len(cmd.spec.DataDisks) > 0 {
+		diskSpecs, err := cmd.dataDiskDeviceChanges(ctx, devices, datastoreref)
+		if err != nil {
+			return nil, errors.Wrap(err, "preparing data disks failed")
+		}
+		deviceChanges = append(deviceChanges, diskSpecs...)
+	}
+	if len(deviceChanges) > 0 {
+		task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{DeviceChange: deviceChanges})
+		if err != nil {
+			return nil, errors.Wrap(err, "starting reconfiguring devices of deployed VM failed")
+		}
+		if _, err = task.WaitForResult(ctx, nil); err != nil {
+			return nil, errors.Wrap(err, "reconfiguring devices of deployed VM failed")
+		}
+	}
+
+	customSpec, err := cmd.customizationSpec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if customSpec != nil {
+		task, err := vm.Customize(ctx, *customSpec)
+		if err != nil {
+			return nil, errors.Wrap(err, "starting customizing deployed VM failed")
+		}
+		if _, err = task.WaitForResult(ctx, nil); err != nil {
+			return nil, errors.Wrap(err, "customizing deployed VM failed")
+		}
+	}
+
+	return vm, nil
+}
+
+// findLibraryItem looks up the content library item either by ID or by library and item name
+func (cmd *clone) findLibraryItem(ctx context.Context) (*library.Item, error) {
+	manager := library.NewManager(cmd.RestClient)
+	if cmd.LibraryItem.ID != "" {
+		item, err := manager.GetLibraryItem(ctx, cmd.LibraryItem.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "content library: retrieving library item %s failed", cmd.LibraryItem)
+		}
+		return item, nil
+	}
+
+	lib, err := manager.GetLibraryByName(ctx, cmd.LibraryItem.Library)
+	if err != nil {
+		return nil, errors.Wrapf(err, "content library: retrieving library %q failed", cmd.LibraryItem.Library)
+	}
+	ids, err := manager.FindLibraryItems(ctx, library.FindItem{LibraryID: lib.ID, Name: cmd.LibraryItem.Name})
+	if err != nil {
+		return nil, errors.Wrapf(err, "content library: finding library item %s failed", cmd.LibraryItem)
+	}
+	switch len(ids) {
+	case 0:
+		return nil, fmt.Errorf("content library: library item %s not found", cmd.LibraryItem)
+	case 1:
+	default:
+		return nil, fmt.Errorf("content library: library item %s is ambiguous", cmd.LibraryItem)
+	}
+	item, err := manager.GetLibraryItem(ctx, ids[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "content library: retrieving library item %s failed", cmd.LibraryItem)
+	}
+	return item, nil
+}
+
+// libraryDatastore returns the data store to deploy the library item to.
+// For a datastore cluster, the data store is chosen by a storage DRS recommendation,
+// for a storage policy without data store by the policy.
+func (cmd *clone) libraryDatastore(ctx context.Context) (types.ManagedObjectReference, error) {
+	if cmd.Datastore != nil {
+		return cmd.Datastore.Reference(), nil
+	}
+
+	if cmd.usesStoragePolicyPlacement() {
+		return cmd.compatibleDatastore(ctx, cmd.profileID)
+	}
+
+	if cmd.StoragePod == nil {
+		datastoreFlag, _ := flags.NewDatastoreFlag(ctx)
+		datastore, err := datastoreFlag.Datastore()
+		if err != nil {
+			return types.ManagedObjectReference{}, errors.Wrap(err, "preparing DatastoreFlag failed")
+		}
+		return datastore.Reference(), nil
+	}
+
+	storagePod := cmd.StoragePod.Reference()
+	poolref := cmd.ResourcePool.Reference()
+	folderref := cmd.Folder.Reference()
+	storagePlacementSpec := types.StoragePlacementSpec{
+		Type:             string(types.StoragePlacementSpecPlacementTypeCreate),
+		ResourcePool:     &poolref,
+		Folder:           &folderref,
+		PodSelectionSpec: types.StorageDrsPodSelectionSpec{StoragePod: &storagePod},
+		ConfigSpec: &types.VirtualMachineConfigSpec{
+			Name:  cmd.name,
+			Files: &types.VirtualMachineFileInfo{},
+		},
+	}
+	if cmd.HostSystem != nil {
+		hostref := cmd.HostSystem.Reference()
+		storagePlacementSpec.Host = &hostref
+	}
+
+	storageResourceManager := object.NewStorageResourceManager(cmd.Client)
+	result, err := storageResourceManager.RecommendDatastores(ctx, storagePlacementSpec)
+	if err != nil {
+		return types.ManagedObjectReference{}, errors.Wrap(err, "retrieving storage placement result failed")
+	}
+	if len(result.Recommendations) == 0 {
+		return types.ManagedObjectReference{}, fmt.Errorf("no datastore-cluster recommendations")
+	}
+	return result.Recommendations[0].Action[0].(*types.StoragePlacementAction).Destination, nil
+}
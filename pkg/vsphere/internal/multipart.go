@@ -0,0 +1,137 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cloudConfigMergeType lets the injected cloud-config part append to lists and keep keys of preceding parts,
+// see https://cloudinit.readthedocs.io/en/latest/reference/merging.html
+const cloudConfigMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+// userDataContentTypes maps the first line of single part user data to the MIME content type
+var userDataContentTypes = map[string]string{
+	"#include":              "text/x-include-url",
+	"#cloud-boothook":       "text/cloud-boothook",
+	"#cloud-config-archive": "text/cloud-config-archive",
+	"#upstart-job":          "text/upstart-job",
+	"#part-handler":         "text/part-handler",
+	"## template: jinja":    "text/jinja2",
+}
+
+// isMultipart returns true if the user data is a MIME multipart document
+func isMultipart(userdata string) bool {
+	prefix := userdata
+	if len(prefix) > 64 {
+		prefix = prefix[:64]
+	}
+	prefix = strings.ToLower(prefix)
+	if !strings.HasPrefix(prefix, "content-type:") && !strings.HasPrefix(prefix, "mime-version:") {
+		return false
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(userdata))
+	if err != nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// mergeMultipart appends a cloud-config part with the SSH keys, hostname and fqdn to the multipart user data.
+// The existing parts are copied unchanged.
+func mergeMultipart(userdata string, sshKeys []string, hostname, fqdn string) (string, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(userdata))
+	if err != nil {
+		return "", errors.Wrap(err, "parsing multipart user data failed")
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return "", errors.Wrap(err, "parsing multipart user data failed")
+	}
+	if params["boundary"] == "" {
+		return "", fmt.Errorf("multipart user data without boundary")
+	}
+
+	var parts []userDataPart
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "parsing multipart user data failed")
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing multipart user data failed")
+		}
+		parts = append(parts, userDataPart{header: part.Header, content: content})
+	}
+	return writeMultipart(mediaType, parts, sshKeys, hostname, fqdn)
+}
+
+// wrapInMultipart packages single part user data of other types than cloud-config and shell script in a
+// multipart document together with a cloud-config part with the SSH keys, hostname and fqdn.
+func wrapInMultipart(userdata, contentType string, sshKeys []string, hostname, fqdn string) (string, error) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	return writeMultipart("multipart/mixed", []userDataPart{{header: header, content: []byte(userdata)}}, sshKeys, hostname, fqdn)
+}
+
+type userDataPart struct {
+	header  textproto.MIMEHeader
+	content []byte
+}
+
+func writeMultipart(mediaType string, parts []userDataPart, sshKeys []string, hostname, fqdn string) (string, error) {
+	cloudConfig, err := mergeCloudConfig("", sshKeys, hostname, fqdn)
+	if err != nil {
+		return "", err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("text/cloud-config", map[string]string{"charset": "utf-8"}))
+	header.Set("Merge-Type", cloudConfigMergeType)
+	parts = append(parts, userDataPart{header: header, content: []byte(cloudConfig)})
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		w, err := writer.CreatePart(part.header)
+		if err != nil {
+			return "", errors.Wrap(err, "writing multipart user data failed")
+		}
+		if _, err = w.Write(part.content); err != nil {
+			return "", errors.Wrap(err, "writing multipart user data failed")
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", errors.Wrap(err, "writing multipart user data failed")
+	}
+
+	contentType := mime.FormatMediaType(mediaType, map[string]string{"boundary": writer.Boundary()})
+	return "Content-Type: " + contentType + "\r\nMIME-Version: 1.0\r\n\r\n" + body.String(), nil
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"sigs.k8s.io/yaml"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// guestNetworkInterface is the guest view of a network interface used to generate the guest network config
+type guestNetworkInterface struct {
+	MACAddress    string
+	IPAddresses   []string
+	Gateways      []string
+	Nameservers   []string
+	SearchDomains []string
+}
+
+func (nic *guestNetworkInterface) dhcp() bool {
+	return len(nic.IPAddresses) == 0
+}
+
+// hasStaticNetworking returns true if any network interface has static IP addresses
+func hasStaticNetworking(spec *api.VsphereProviderSpec) bool {
+	for _, nic := range spec.Networks {
+		if len(nic.IPAddresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newGuestNetworkInterfaces combines the network interfaces of the spec with the MAC addresses of their
+// network cards, see matchNetworkCards.
+func newGuestNetworkInterfaces(spec *api.VsphereProviderSpec, devices object.VirtualDeviceList, nicCards []types.BaseVirtualDevice) ([]guestNetworkInterface, error) {
+	cards, err := matchNetworkCards(devices, nicCards)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) < len(spec.Networks) {
+		return nil, fmt.Errorf("VM has %d network cards, but %d network interfaces are specified", len(cards), len(spec.Networks))
+	}
+
+	nics := make([]guestNetworkInterface, len(spec.Networks))
+	for i, nic := range spec.Networks {
+		nics[i] = newGuestNetworkInterface(nic, cards[i].(types.BaseVirtualEthernetCard).GetVirtualEthernetCard().MacAddress)
+	}
+	return nics, nil
+}
+
+// placeholderGuestNetworkInterfaces returns the guest network interfaces with a placeholder MAC address of the
+// same length, e.g. to check the size of the bootstrap data before the network cards exist.
+func placeholderGuestNetworkInterfaces(spec *api.VsphereProviderSpec) []guestNetworkInterface {
+	if !hasStaticNetworking(spec) {
+		return nil
+	}
+	nics := make([]guestNetworkInterface, len(spec.Networks))
+	for i, nic := range spec.Networks {
+		nics[i] = newGuestNetworkInterface(nic, "00:00:00:00:00:00")
+	}
+	return nics
+}
+
+func newGuestNetworkInterface(nic api.VSphereNetworkInterface, macAddress string) guestNetworkInterface {
+	return guestNetworkInterface{
+		MACAddress:    macAddress,
+		IPAddresses:   nic.IPAddresses,
+		Gateways:      nic.Gateways,
+		Nameservers:   nic.Nameservers,
+		SearchDomains: nic.SearchDomains,
+	}
+}
+
+// matchNetworkCards returns the network cards of the VM in the order of the cards configured by
+// networkDeviceChanges. Edited template cards keep their device key. Added cards get their key from vSphere
+// and are appended to the device list, so they are matched by adapter type and network backing in device order.
+// Without configured cards, the network cards of the VM are returned in device order.
+func matchNetworkCards(devices object.VirtualDeviceList, nicCards []types.BaseVirtualDevice) ([]types.BaseVirtualDevice, error) {
+	cards := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+	if len(nicCards) == 0 {
+		return cards, nil
+	}
+
+	matched := make([]types.BaseVirtualDevice, len(nicCards))
+	used := map[int32]bool{}
+	for i, nicCard := range nicCards {
+		if key := nicCard.GetVirtualDevice().Key; key > 0 {
+			if card := cards.FindByKey(key); card != nil {
+				matched[i] = card
+				used[key] = true
+			}
+		}
+	}
+	for i, nicCard := range nicCards {
+		if matched[i] != nil {
+			continue
+		}
+		for _, card := range cards {
+			if used[card.GetVirtualDevice().Key] || devices.TypeName(card) != devices.TypeName(nicCard) {
+				continue
+			}
+			if sameNetworkBacking(card.GetVirtualDevice().Backing, nicCard.GetVirtualDevice().Backing) {
+				matched[i] = card
+				used[card.GetVirtualDevice().Key] = true
+				break
+			}
+		}
+		if matched[i] == nil {
+			return nil, fmt.Errorf("network card of network interface %d not found", i)
+		}
+	}
+	return matched, nil
+}
+
+// sameNetworkBacking checks if both backings connect to the same network
+func sameNetworkBacking(a, b types.BaseVirtualDeviceBackingInfo) bool {
+	switch a := a.(type) {
+	case *types.VirtualEthernetCardNetworkBackingInfo:
+		b, ok := b.(*types.VirtualEthernetCardNetworkBackingInfo)
+		return ok && a.DeviceName == b.DeviceName
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		b, ok := b.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo)
+		return ok && a.Port.SwitchUuid == b.Port.SwitchUuid && a.Port.PortgroupKey == b.Port.PortgroupKey
+	case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+		b, ok := b.(*types.VirtualEthernetCardOpaqueNetworkBackingInfo)
+		return ok && a.OpaqueNetworkId == b.OpaqueNetworkId && a.OpaqueNetworkType == b.OpaqueNetworkType
+	}
+	return false
+}
+
+type cloudInitNetworkConfig struct {
+	Version   int                                  `json:"version"`
+	Ethernets map[string]cloudInitNetworkConfigNIC `json:"ethernets"`
+}
+
+type cloudInitNetworkConfigNIC struct {
+	Match       cloudInitNetworkConfigMatch        `json:"match"`
+	DHCP4       bool                               `json:"dhcp4"`
+	Addresses   []string                           `json:"addresses,omitempty"`
+	Routes      []cloudInitNetworkConfigRoute      `json:"routes,omitempty"`
+	Nameservers *cloudInitNetworkConfigNameservers `json:"nameservers,omitempty"`
+}
+
+type cloudInitNetworkConfigMatch struct {
+	MACAddress string `json:"macaddress"`
+}
+
+type cloudInitNetworkConfigRoute struct {
+	To  string `json:"to"`
+	Via string `json:"via"`
+}
+
+type cloudInitNetworkConfigNameservers struct {
+	Addresses []string `json:"addresses,omitempty"`
+	Search    []string `json:"search,omitempty"`
+}
+
+// cloudInitNetworkConfigV2 renders the network interfaces as cloud-init network config version 2
+func cloudInitNetworkConfigV2(nics []guestNetworkInterface) (string, error) {
+	config := cloudInitNetworkConfig{
+		Version:   2,
+		Ethernets: map[string]cloudInitNetworkConfigNIC{},
+	}
+	for i, nic := range nics {
+		ethernet := cloudInitNetworkConfigNIC{
+			Match:     cloudInitNetworkConfigMatch{MACAddress: nic.MACAddress},
+			DHCP4:     nic.dhcp(),
+			Addresses: nic.IPAddresses,
+		}
+		for _, gateway := range nic.Gateways {
+			ethernet.Routes = append(ethernet.Routes, cloudInitNetworkConfigRoute{To: defaultRoute(gateway), Via: gateway})
+		}
+		if len(nic.Nameservers) > 0 || len(nic.SearchDomains) > 0 {
+			ethernet.Nameservers = &cloudInitNetworkConfigNameservers{
+				Addresses: nic.Nameservers,
+				Search:    nic.SearchDomains,
+			}
+		}
+		config.Ethernets[fmt.Sprintf("nic%d", i)] = ethernet
+	}
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func defaultRoute(gateway string) string {
+	if ip := net.ParseIP(gateway); ip != nil && ip.To4() == nil {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+type networkdUnit struct {
+	Contents string `json:"contents"`
+	Name     string `json:"name"`
+}
+
+// defaultNetworkdUnits is used if no static networking is configured
+var defaultNetworkdUnits = []networkdUnit{
+	{
+		Name:     "00-ens192.network",
+		Contents: "[Match]\nName=ens192\n\n[Network]\nDHCP=yes\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n",
+	},
+}
+
+// networkdUnitsFor renders the network interfaces as systemd-networkd units
+func networkdUnitsFor(nics []guestNetworkInterface) []networkdUnit {
+	var units []networkdUnit
+	for i, nic := range nics {
+		sb := strings.Builder{}
+		sb.WriteString(fmt.Sprintf("[Match]\nMACAddress=%s\n\n[Network]\n", nic.MACAddress))
+		if nic.dhcp() {
+			sb.WriteString("DHCP=yes\n")
+		}
+		for _, address := range nic.IPAddresses {
+			sb.WriteString(fmt.Sprintf("Address=%s\n", address))
+		}
+		for _, gateway := range nic.Gateways {
+			sb.WriteString(fmt.Sprintf("Gateway=%s\n", gateway))
+		}
+		for _, nameserver := range nic.Nameservers {
+			sb.WriteString(fmt.Sprintf("DNS=%s\n", nameserver))
+		}
+		if len(nic.SearchDomains) > 0 {
+			sb.WriteString(fmt.Sprintf("Domains=%s\n", strings.Join(nic.SearchDomains, " ")))
+		}
+		sb.WriteString("LinkLocalAddressing=no\nIPv6AcceptRA=no\n")
+		units = append(units, networkdUnit{
+			Name:     fmt.Sprintf("00-nic%d.network", i),
+			Contents: sb.String(),
+		})
+	}
+	return units
+}
+
+// customizationNetworkSettings renders the network interfaces of the spec as NIC settings and global IP
+// settings of a guest customization specification. The adapter mappings are applied to the network cards in order.
+func customizationNetworkSettings(spec *api.VsphereProviderSpec) ([]types.CustomizationAdapterMapping, types.CustomizationGlobalIPSettings, error) {
+	var (
+		mappings []types.CustomizationAdapterMapping
+		global   types.CustomizationGlobalIPSettings
+	)
+
+	for i, nic := range spec.Networks {
+		adapter := types.CustomizationIPSettings{
+			DnsServerList: nic.Nameservers,
+		}
+		for _, address := range nic.IPAddresses {
+			ip, ipnet, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, global, fmt.Errorf("networks[%d]: invalid IP address %q", i, address)
+			}
+			ones, _ := ipnet.Mask.Size()
+			if ip.To4() != nil {
+				if adapter.Ip != nil {
+					return nil, global, fmt.Errorf("networks[%d]: guest customization supports only one IPv4 address", i)
+				}
+				adapter.Ip = &types.CustomizationFixedIp{IpAddress: ip.String()}
+				adapter.SubnetMask = net.IP(ipnet.Mask).String()
+				continue
+			}
+			if adapter.IpV6Spec == nil {
+				adapter.IpV6Spec = &types.CustomizationIPSettingsIpV6AddressSpec{}
+			}
+			adapter.IpV6Spec.Ip = append(adapter.IpV6Spec.Ip, &types.CustomizationFixedIpV6{IpAddress: ip.String(), SubnetMask: int32(ones)})
+		}
+		if adapter.Ip == nil {
+			adapter.Ip = &types.CustomizationDhcpIpGenerator{}
+		}
+		for _, gateway := range nic.Gateways {
+			if defaultRoute(gateway) == "0.0.0.0/0" {
+				adapter.Gateway = append(adapter.Gateway, gateway)
+			} else if adapter.IpV6Spec != nil {
+				adapter.IpV6Spec.Gateway = append(adapter.IpV6Spec.Gateway, gateway)
+			}
+		}
+		mappings = append(mappings, types.CustomizationAdapterMapping{Adapter: adapter})
+		global.DnsServerList = appendMissing(global.DnsServerList, nic.Nameservers...)
+		global.DnsSuffixList = appendMissing(global.DnsSuffixList, nic.SearchDomains...)
+	}
+
+	return mappings, global, nil
+}
+
+func appendMissing(list []string, values ...string) []string {
+outer:
+	for _, value := range values {
+		for _, existing := range list {
+			if existing == value {
+				continue outer
+			}
+		}
+		list = append(list, value)
+	}
+	return list
+}
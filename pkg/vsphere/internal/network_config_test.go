@@ -0,0 +1,113 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+var testNICs = []guestNetworkInterface{
+	{
+		MACAddress:    "00:50:56:00:00:01",
+		IPAddresses:   []string{"10.0.0.10/24"},
+		Gateways:      []string{"10.0.0.1"},
+		Nameservers:   []string{"10.0.0.2"},
+		SearchDomains: []string{"example.com"},
+	},
+	{
+		MACAddress: "00:50:56:00:00:02",
+	},
+}
+
+func TestCloudInitNetworkConfigV2(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	config, err := cloudInitNetworkConfigV2(testNICs)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(config).To(gomega.Equal(`ethernets:
+  nic0:
+    addresses:
+    - 10.0.0.10/24
+    dhcp4: false
+    match:
+      macaddress: "00:50:56:00:00:01"
+    nameservers:
+      addresses:
+      - 10.0.0.2
+      search:
+      - example.com
+    routes:
+    - to: 0.0.0.0/0
+      via: 10.0.0.1
+  nic1:
+    dhcp4: true
+    match:
+      macaddress: "00:50:56:00:00:02"
+version: 2
+`))
+}
+
+func TestNetworkdUnits(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	units := networkdUnitsFor(testNICs)
+	g.Expect(units).To(gomega.Equal([]networkdUnit{
+		{
+			Name:     "00-nic0.network",
+			Contents: "[Match]\nMACAddress=00:50:56:00:00:01\n\n[Network]\nAddress=10.0.0.10/24\nGateway=10.0.0.1\nDNS=10.0.0.2\nDomains=example.com\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n",
+		},
+		{
+			Name:     "00-nic1.network",
+			Contents: "[Match]\nMACAddress=00:50:56:00:00:02\n\n[Network]\nDHCP=yes\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n",
+		},
+	}))
+}
+
+func TestCustomizationNetworkSettings(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &api.VsphereProviderSpec{
+		Networks: []api.VSphereNetworkInterface{
+			{
+				Name:          "nw1",
+				IPAddresses:   []string{"10.0.0.10/24", "fd00::10/64"},
+				Gateways:      []string{"10.0.0.1", "fd00::1"},
+				Nameservers:   []string{"10.0.0.2"},
+				SearchDomains: []string{"example.com"},
+			},
+			{Name: "nw2"},
+		},
+	}
+	mappings, global, err := customizationNetworkSettings(spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(mappings).To(gomega.HaveLen(2))
+	g.Expect(mappings[0].Adapter.Ip).To(gomega.Equal(&types.CustomizationFixedIp{IpAddress: "10.0.0.10"}))
+	g.Expect(mappings[0].Adapter.SubnetMask).To(gomega.Equal("255.255.255.0"))
+	g.Expect(mappings[0].Adapter.Gateway).To(gomega.Equal([]string{"10.0.0.1"}))
+	g.Expect(mappings[0].Adapter.IpV6Spec.Ip).To(gomega.Equal([]types.BaseCustomizationIpV6Generator{
+		&types.CustomizationFixedIpV6{IpAddress: "fd00::10", SubnetMask: 64},
+	}))
+	g.Expect(mappings[0].Adapter.IpV6Spec.Gateway).To(gomega.Equal([]string{"fd00::1"}))
+	g.Expect(mappings[1].Adapter.Ip).To(gomega.Equal(&types.CustomizationDhcpIpGenerator{}))
+	g.Expect(global.DnsServerList).To(gomega.Equal([]string{"10.0.0.2"}))
+	g.Expect(global.DnsSuffixList).To(gomega.Equal([]string{"example.com"}))
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/flags"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/internal/iso9660"
+)
+
+// noCloudVolumeID is the volume label the cloud-init NoCloud datasource looks for
+const noCloudVolumeID = "cidata"
+
+// noCloudISOBootstrap provides cloud-init user data, metadata and network config on a seed ISO image
+// for the NoCloud datasource. The image is uploaded to the folder of the VM and attached as CD-ROM.
+// See https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+type noCloudISOBootstrap struct{}
+
+func (noCloudISOBootstrap) prepare(in *bootstrapInput) (*bootstrapData, error) {
+	in.console.warnIgnored(api.BootstrapFormatNoCloudISO)
+	newUserdata, err := prepareUserData(in.userData, in.sshKeys, in.hostname, in.fqdn())
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := cloudInitMetadata(in.hostname, nil)
+	if err != nil {
+		return nil, err
+	}
+	files := []iso9660.File{
+		{Name: "user-data", Content: []byte(newUserdata)},
+		{Name: "meta-data", Content: []byte(metadata)},
+	}
+	if len(in.nics) > 0 {
+		networkConfig, err := cloudInitNetworkConfigV2(in.nics)
+		if err != nil {
+			return nil, errors.Wrap(err, "generating network config failed")
+		}
+		files = append(files, iso9660.File{Name: "network-config", Content: []byte(networkConfig)})
+	}
+	image, err := iso9660.Create(noCloudVolumeID, files)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating seed ISO image failed")
+	}
+	return &bootstrapData{seedISO: image}, nil
+}
+
+// seedISOName returns the file name of the seed ISO image in the folder of the VM
+func seedISOName(vmName string) string {
+	return vmName + "-cidata.iso"
+}
+
+// attachSeedISO uploads the seed ISO image to the folder of the VM and returns the device changes to attach it.
+// An existing CD-ROM drive of the template is reused, otherwise a drive is added on an IDE or SATA controller.
+func (cmd *clone) attachSeedISO(ctx context.Context, vm *object.VirtualMachine, image []byte) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	var props mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.files", "config.hardware.device"}, &props); err != nil {
+		return nil, errors.Wrap(err, "retrieving VM properties failed")
+	}
+	var vmxPath object.DatastorePath
+	if !vmxPath.FromString(props.Config.Files.VmPathName) {
+		return nil, fmt.Errorf("invalid VM path %q", props.Config.Files.VmPathName)
+	}
+	datastoreFlag, _ := flags.NewCustomDatastoreFlag(ctx)
+	datastoreFlag.Name = vmxPath.Datastore
+	ds, err := datastoreFlag.Datastore()
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing DatastoreFlag failed")
+	}
+	isoPath := path.Join(path.Dir(vmxPath.Path), seedISOName(cmd.name))
+	upload := soap.DefaultUpload
+	upload.ContentLength = int64(len(image))
+	if err = ds.Upload(ctx, bytes.NewReader(image), isoPath, &upload); err != nil {
+		return nil, errors.Wrap(err, "uploading seed ISO image failed")
+	}
+	klog.V(2).Infof("Uploaded seed ISO image %s", ds.Path(isoPath))
+
+	devices := object.VirtualDeviceList(props.Config.Hardware.Device)
+	if cdroms := devices.SelectByType((*types.VirtualCdrom)(nil)); len(cdroms) > 0 {
+		cdrom := devices.InsertIso(cdroms[0].(*types.VirtualCdrom), ds.Path(isoPath))
+		cdrom.Connectable = &types.VirtualDeviceConnectInfo{AllowGuestControl: true, StartConnected: true}
+		return []types.BaseVirtualDeviceConfigSpec{&types.VirtualDeviceConfigSpec{Operation: types.VirtualDeviceConfigSpecOperationEdit, Device: cdrom}}, nil
+	}
+
+	var (
+		controller  types.BaseVirtualController
+		configSpecs []types.BaseVirtualDeviceConfigSpec
+	)
+	if ide, err := devices.FindIDEController(""); err == nil {
+		controller = ide
+	} else {
+		sata, created, err := findOrCreateController(devices, api.ControllerTypeSATA, nil)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			devices = append(devices, sata.(types.BaseVirtualDevice))
+			configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationAdd,
+				Device:    sata.(types.BaseVirtualDevice),
+			})
+		}
+		controller = sata
+	}
+	cdrom := &types.VirtualCdrom{}
+	devices.AssignController(cdrom, controller)
+	devices.InsertIso(cdrom, ds.Path(isoPath))
+	cdrom.Connectable = &types.VirtualDeviceConnectInfo{AllowGuestControl: true, StartConnected: true}
+	configSpecs = append(configSpecs, &types.VirtualDeviceConfigSpec{Operation: types.VirtualDeviceConfigSpecOperationAdd, Device: cdrom})
+	return configSpecs, nil
+}
+
+// seedISOFiles returns the datastore paths of seed ISO images attached to the VM
+func seedISOFiles(ctx context.Context, vm *object.VirtualMachine) ([]string, error) {
+	var props mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"name", "config.hardware.device"}, &props); err != nil {
+		return nil, errors.Wrap(err, "retrieving VM properties failed")
+	}
+	if props.Config == nil {
+		return nil, nil
+	}
+	var files []string
+	for _, device := range object.VirtualDeviceList(props.Config.Hardware.Device).SelectByType((*types.VirtualCdrom)(nil)) {
+		backing, ok := device.GetVirtualDevice().Backing.(*types.VirtualCdromIsoBackingInfo)
+		if !ok {
+			continue
+		}
+		var p object.DatastorePath
+		if p.FromString(backing.FileName) && path.Base(p.Path) == seedISOName(props.Name) {
+			files = append(files, backing.FileName)
+		}
+	}
+	return files, nil
+}
+
+// deleteSeedISOFiles deletes the seed ISO images of a powered off VM, as they are not deleted with the VM
+func deleteSeedISOFiles(ctx context.Context, client *govmomi.Client, spec *api.VsphereProviderSpec, files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ctx = flags.ContextWithPseudoFlagset(ctx, client, spec)
+	datacenterFlag, _ := flags.NewDatacenterFlag(ctx)
+	dc, err := datacenterFlag.Datacenter()
+	if err != nil {
+		return err
+	}
+	fileManager := object.NewFileManager(client.Client)
+	for _, file := range files {
+		task, err := fileManager.DeleteDatastoreFile(ctx, file, dc)
+		if err != nil {
+			return errors.Wrapf(err, "starting deleting %s failed", file)
+		}
+		if err = task.Wait(ctx); err != nil && !types.IsFileNotFound(err) {
+			return errors.Wrapf(err, "deleting %s failed", file)
+		}
+	}
+	return nil
+}
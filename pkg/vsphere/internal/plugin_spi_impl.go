@@ -23,13 +23,16 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	corev1 "k8s.io/api/core/v1"
 
 	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/contentlibrary"
 	"github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis/tags"
 )
 
@@ -48,6 +51,16 @@ func (spi *PluginSPIImpl) CreateMachine(ctx context.Context, machineName string,
 	defer client.Logout(ctx)
 
 	cmd := newClone(machineName, providerSpec, string(secrets.Data["userData"]))
+	cmd.console = consoleCredentialsFrom(secrets)
+	cmd.secretData = secrets.Data
+	if contentlibrary.IsLibraryTemplate(providerSpec.TemplateVM) || usesVSphereTags(providerSpec) {
+		restClient, err := createRestClient(ctx, client, secrets)
+		if err != nil {
+			return "", err
+		}
+		defer restClient.Logout(ctx)
+		cmd.RestClient = restClient
+	}
 	err = cmd.Run(ctx, client)
 	if err != nil {
 		return "", err
@@ -58,6 +71,10 @@ func (spi *PluginSPIImpl) CreateMachine(ctx context.Context, machineName string,
 }
 
 func (spi *PluginSPIImpl) encodeProviderID(region, machineID string) string {
+	return encodeProviderID(region, machineID)
+}
+
+func encodeProviderID(region, machineID string) string {
 	if machineID == "" {
 		return ""
 	}
@@ -148,6 +165,12 @@ func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.Vs
 		return machineList, nil
 	}
 
+	type candidate struct {
+		vm           *object.VirtualMachine
+		name         string
+		customValues map[string]string
+	}
+	var candidates []candidate
 	visitor := func(vm *object.VirtualMachine, obj mo.ManagedEntity, field object.CustomFieldDefList) error {
 		customValues := map[string]string{}
 		for _, cv := range obj.CustomValue {
@@ -155,11 +178,10 @@ func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.Vs
 			customValues[field.ByKey(sv.Key).Name] = sv.Value
 		}
 
-		if relevantTags.Matches(customValues) {
-			uuid := vm.UUID(ctx)
-			providerID := spi.encodeProviderID(providerSpec.Region, uuid)
-			machineList[providerID] = obj.Name
+		if !usesVSphereTags(providerSpec) && !relevantTags.Matches(customValues) {
+			return nil
 		}
+		candidates = append(candidates, candidate{vm: vm, name: obj.Name, customValues: customValues})
 		return nil
 	}
 
@@ -168,6 +190,32 @@ func (spi *PluginSPIImpl) ListMachines(ctx context.Context, providerSpec *api.Vs
 		return nil, err
 	}
 
+	// VMs may be tagged either by custom attributes or by vSphere tags, depending on the tag mode used on creation
+	var vsphereTags map[types.ManagedObjectReference]map[string]string
+	if usesVSphereTags(providerSpec) {
+		restClient, err := createRestClient(ctx, client, secrets)
+		if err != nil {
+			return nil, err
+		}
+		defer restClient.Logout(ctx)
+
+		refs := make([]mo.Reference, len(candidates))
+		for i, c := range candidates {
+			refs[i] = c.vm
+		}
+		if vsphereTags, err = vsphereTagsOnObjects(ctx, restClient, refs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range candidates {
+		if relevantTags.Matches(c.customValues) || relevantTags.Matches(vsphereTags[c.vm.Reference()]) {
+			uuid := c.vm.UUID(ctx)
+			providerID := spi.encodeProviderID(providerSpec.Region, uuid)
+			machineList[providerID] = c.name
+		}
+	}
+
 	return machineList, nil
 }
 
@@ -183,3 +231,14 @@ func createVsphereClient(ctx context.Context, secret *corev1.Secret) (*govmomi.C
 	vsphereInsecureSSL := strings.ToLower(string(secret.Data["vsphereInsecureSSL"])) == "true" || string(secret.Data["vsphereInsecureSSL"]) == "1"
 	return govmomi.NewClient(ctx, clientURL, vsphereInsecureSSL)
 }
+
+// createRestClient creates a client for the vAPI (e.g. content library) sharing the connection of the vSphere client.
+// The vSphere client does not keep the credentials, therefore they are taken from the secret again.
+func createRestClient(ctx context.Context, client *govmomi.Client, secret *corev1.Secret) (*rest.Client, error) {
+	restClient := rest.NewClient(client.Client)
+	user := url.UserPassword(string(secret.Data["vsphereUsername"]), string(secret.Data["vspherePassword"]))
+	if err := restClient.Login(ctx, user); err != nil {
+		return nil, errors.Wrap(err, "login to vAPI endpoint failed")
+	}
+	return restClient, nil
+}
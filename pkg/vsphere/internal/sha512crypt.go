@@ -0,0 +1,145 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"math/big"
+	"strings"
+)
+
+// SHA-512 based crypt as specified in https://www.akkadia.org/drepper/SHA-crypt.txt,
+// producing password hashes of the form $6$<salt>$<hash> understood by glibc.
+
+const (
+	sha512CryptPrefix = "$6$"
+	sha512CryptRounds = 5000
+	sha512CryptSalt   = 16
+	cryptAlphabet     = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// hashPassword returns the SHA-512 crypt hash of the password with a random salt
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, sha512CryptSalt)
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(cryptAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		salt[i] = cryptAlphabet[n.Int64()]
+	}
+	return sha512Crypt(password, string(salt)), nil
+}
+
+// sha512Crypt returns the SHA-512 crypt hash of the password with the salt and the default number of rounds
+func sha512Crypt(password, salt string) string {
+	if len(salt) > sha512CryptSalt {
+		salt = salt[:sha512CryptSalt]
+	}
+	key := []byte(password)
+	saltBytes := []byte(salt)
+
+	digestB := sha512.New()
+	digestB.Write(key)
+	digestB.Write(saltBytes)
+	digestB.Write(key)
+	b := digestB.Sum(nil)
+
+	digestA := sha512.New()
+	digestA.Write(key)
+	digestA.Write(saltBytes)
+	cnt := len(key)
+	for ; cnt > 64; cnt -= 64 {
+		digestA.Write(b)
+	}
+	digestA.Write(b[:cnt])
+	for cnt = len(key); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			digestA.Write(b)
+		} else {
+			digestA.Write(key)
+		}
+	}
+	a := digestA.Sum(nil)
+
+	digestDP := sha512.New()
+	for i := 0; i < len(key); i++ {
+		digestDP.Write(key)
+	}
+	p := repeatBytes(digestDP.Sum(nil), len(key))
+
+	digestDS := sha512.New()
+	for i := 0; i < 16+int(a[0]); i++ {
+		digestDS.Write(saltBytes)
+	}
+	s := repeatBytes(digestDS.Sum(nil), len(saltBytes))
+
+	for i := 0; i < sha512CryptRounds; i++ {
+		digestC := sha512.New()
+		if i&1 != 0 {
+			digestC.Write(p)
+		} else {
+			digestC.Write(a)
+		}
+		if i%3 != 0 {
+			digestC.Write(s)
+		}
+		if i%7 != 0 {
+			digestC.Write(p)
+		}
+		if i&1 != 0 {
+			digestC.Write(a)
+		} else {
+			digestC.Write(p)
+		}
+		a = digestC.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512CryptPrefix)
+	out.WriteString(salt)
+	out.WriteString("$")
+	for _, t := range [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	} {
+		encodeCrypt64(&out, a[t[0]], a[t[1]], a[t[2]], 4)
+	}
+	encodeCrypt64(&out, 0, 0, a[63], 2)
+	return out.String()
+}
+
+func repeatBytes(digest []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(digest) {
+			n = len(digest)
+		}
+		result = append(result, digest[:n]...)
+	}
+	return result
+}
+
+func encodeCrypt64(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// test vectors from the specification
+	g.Expect(sha512Crypt("Hello world!", "saltstring")).To(gomega.Equal("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"))
+	g.Expect(sha512Crypt("This is just a test", "toolongsaltstring")).To(gomega.Equal("$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"))
+
+	hash, err := hashPassword("secret")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(hash).To(gomega.HavePrefix("$6$"))
+	salt := strings.Split(hash, "$")[2]
+	g.Expect(sha512Crypt("secret", salt)).To(gomega.Equal(hash))
+}
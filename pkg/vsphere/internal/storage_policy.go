@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog/v2"
+)
+
+// usesStoragePolicyPlacement checks if the data store is chosen by the storage policy
+func (cmd *clone) usesStoragePolicyPlacement() bool {
+	return cmd.spec.StoragePolicy != "" && cmd.spec.Datastore == "" && cmd.spec.DatastoreCluster == ""
+}
+
+// storageProfileID returns the profile ID of the storage policy with the given name
+func (cmd *clone) storageProfileID(ctx context.Context, name string) (string, error) {
+	if id, ok := cmd.storageProfileIDs[name]; ok {
+		return id, nil
+	}
+
+	if cmd.pbmClient == nil {
+		client, err := pbm.NewClient(ctx, cmd.Client)
+		if err != nil {
+			return "", errors.Wrap(err, "creating PBM client failed")
+		}
+		cmd.pbmClient = client
+		cmd.storageProfileIDs = map[string]string{}
+	}
+	id, err := cmd.pbmClient.ProfileIDByName(ctx, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "storage policy %q", name)
+	}
+	cmd.storageProfileIDs[name] = id
+	return id, nil
+}
+
+func storageProfileSpec(profileID string) []types.BaseVirtualMachineProfileSpec {
+	if profileID == "" {
+		return nil
+	}
+	return []types.BaseVirtualMachineProfileSpec{&types.VirtualMachineDefinedProfileSpec{ProfileId: profileID}}
+}
+
+// compatibleDatastore returns the data store with the most free space which is compatible with the storage policy
+// and accessible from the host, cluster or resource pool of the VM.
+func (cmd *clone) compatibleDatastore(ctx context.Context, profileID string) (types.ManagedObjectReference, error) {
+	none := types.ManagedObjectReference{}
+
+	collector := property.DefaultCollector(cmd.Client)
+	var candidates []types.ManagedObjectReference
+	if cmd.HostSystem != nil {
+		var host mo.HostSystem
+		if err := collector.RetrieveOne(ctx, cmd.HostSystem.Reference(), []string{"datastore"}, &host); err != nil {
+			return none, errors.Wrap(err, "retrieving data stores of host system failed")
+		}
+		candidates = host.Datastore
+	} else {
+		var owner types.ManagedObjectReference
+		if cmd.Cluster != nil {
+			owner = cmd.Cluster.Reference()
+		} else {
+			ref, err := cmd.ResourcePool.Owner(ctx)
+			if err != nil {
+				return none, errors.Wrap(err, "retrieving owner of resource pool failed")
+			}
+			owner = ref.Reference()
+		}
+		var computeResource mo.ComputeResource
+		if err := collector.RetrieveOne(ctx, owner, []string{"datastore"}, &computeResource); err != nil {
+			return none, errors.Wrap(err, "retrieving data stores of compute resource failed")
+		}
+		candidates = computeResource.Datastore
+	}
+	if len(candidates) == 0 {
+		return none, fmt.Errorf("no data stores available for storage policy %q", cmd.spec.StoragePolicy)
+	}
+
+	hubs := make([]pbmtypes.PbmPlacementHub, len(candidates))
+	for i, ref := range candidates {
+		hubs[i] = pbmtypes.PbmPlacementHub{HubType: ref.Type, HubId: ref.Value}
+	}
+	requirements := []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{ProfileId: pbmtypes.PbmProfileId{UniqueId: profileID}},
+	}
+	result, err := cmd.pbmClient.CheckRequirements(ctx, hubs, nil, requirements)
+	if err != nil {
+		return none, errors.Wrap(err, "checking storage policy requirements failed")
+	}
+	compatible := result.CompatibleDatastores()
+	if len(compatible) == 0 {
+		return none, fmt.Errorf("no data store compatible with storage policy %q found", cmd.spec.StoragePolicy)
+	}
+
+	refs := make([]types.ManagedObjectReference, len(compatible))
+	for i, hub := range compatible {
+		refs[i] = types.ManagedObjectReference{Type: hub.HubType, Value: hub.HubId}
+	}
+	var datastores []mo.Datastore
+	if err := collector.Retrieve(ctx, refs, []string{"summary"}, &datastores); err != nil {
+		return none, errors.Wrap(err, "retrieving data store summaries failed")
+	}
+	best := mostFreeSpaceDatastore(datastores)
+	if best == nil {
+		return none, fmt.Errorf("no accessible data store compatible with storage policy %q found", cmd.spec.StoragePolicy)
+	}
+	klog.V(2).Infof("Storage policy %q: using data store %s", cmd.spec.StoragePolicy, best.Summary.Name)
+	return best.Reference(), nil
+}
+
+// mostFreeSpaceDatastore returns the accessible data store with the most free space or nil
+func mostFreeSpaceDatastore(datastores []mo.Datastore) *mo.Datastore {
+	var best *mo.Datastore
+	for i := range datastores {
+		ds := &datastores[i]
+		if !ds.Summary.Accessible {
+			continue
+		}
+		if best == nil || ds.Summary.FreeSpace > best.Summary.FreeSpace {
+			best = ds
+		}
+	}
+	return best
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+func TestUsesStoragePolicyPlacement(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(newClone("m", &api.VsphereProviderSpec{}, "").usesStoragePolicyPlacement()).To(gomega.BeFalse())
+	g.Expect(newClone("m", &api.VsphereProviderSpec{StoragePolicy: "gold"}, "").usesStoragePolicyPlacement()).To(gomega.BeTrue())
+	g.Expect(newClone("m", &api.VsphereProviderSpec{StoragePolicy: "gold", Datastore: "ds1"}, "").usesStoragePolicyPlacement()).To(gomega.BeFalse())
+	g.Expect(newClone("m", &api.VsphereProviderSpec{StoragePolicy: "gold", DatastoreCluster: "pod1"}, "").usesStoragePolicyPlacement()).To(gomega.BeFalse())
+}
+
+func TestStorageProfileSpec(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(storageProfileSpec("")).To(gomega.BeNil())
+	g.Expect(storageProfileSpec("profile-1")).To(gomega.Equal([]types.BaseVirtualMachineProfileSpec{
+		&types.VirtualMachineDefinedProfileSpec{ProfileId: "profile-1"},
+	}))
+}
+
+func TestMostFreeSpaceDatastore(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	datastore := func(name string, accessible bool, freeSpace int64) mo.Datastore {
+		return mo.Datastore{Summary: types.DatastoreSummary{Name: name, Accessible: accessible, FreeSpace: freeSpace}}
+	}
+
+	g.Expect(mostFreeSpaceDatastore(nil)).To(gomega.BeNil())
+	g.Expect(mostFreeSpaceDatastore([]mo.Datastore{datastore("ds1", false, 100)})).To(gomega.BeNil())
+
+	best := mostFreeSpaceDatastore([]mo.Datastore{
+		datastore("ds1", true, 100),
+		datastore("ds2", false, 300),
+		datastore("ds3", true, 200),
+	})
+	g.Expect(best.Summary.Name).To(gomega.Equal("ds3"))
+}
@@ -21,53 +21,56 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
-	"text/template"
+	"unicode"
 
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
 )
 
 type ignitionConfig struct {
-	PasswdHash     string
-	Hostname       string
-	SSHKeys        []string
-	UserdataBase64 string
-	InstallPath    string
+	Version       string
+	PasswdHash    string
+	Hostname      string
+	SSHKeys       []string
+	Userdata      string
+	InstallPath   string
+	NetworkdUnits []networkdUnit
 }
 
-func ignitionFile(config *ignitionConfig) (string, error) {
-	ignitionTemplate := `{
-  "ignition": {"config":{},"timeouts":{},"version":"2.1.0"},
-  "networkd":{"units":[{"contents":"[Match]\nName=ens192\n\n[Network]\nDHCP=yes\nLinkLocalAddressing=no\nIPv6AcceptRA=no\n","name":"00-ens192.network"}]},
-  "passwd":{"users":[{"name":"core","passwordHash":"{{.PasswdHash}}","sshAuthorizedKeys":[{{range $index,$elem := .SSHKeys}}{{if $index}},{{end}}"{{$elem}}"{{end}}]}]},
-  "storage": {
-	"directories":[{"filesystem":"root","path":"{{.InstallPath}}","mode":493}],
-	"files":[
-	  {"filesystem":"root","path":"/etc/hostname","contents":{"source":"data:,{{.Hostname}}"},"mode":420},
-	  {"filesystem":"root","path":"{{.InstallPath}}/user_data","contents":{"source":"data:text/plain;charset=utf-8;base64,{{.UserdataBase64}}"},"mode":420}
-	]
-  },
-  "systemd":{}
-}
-`
-	tmpl, err := template.New("ignition").Parse(ignitionTemplate)
-	if err != nil {
-		return "", errors.Wrap(err, "Creating ignition file for CoreOS failed")
-	}
-	buf := bytes.NewBufferString("")
-	err = tmpl.Execute(buf, config)
-	if err != nil {
-		return "", errors.Wrap(err, "Creating ignition file for CoreOS failed on executing template")
+const cloudConfigHeader = "#cloud-config"
+
+// prepareUserData returns the user data as cloud-config with the SSH keys, hostname and fqdn merged in.
+// Shell scripts are packaged in a cloud-config. Multipart user data and other formats supported by cloud-init
+// get an additional cloud-config part. User data of unknown format is returned unchanged.
+func prepareUserData(userdata string, sshKeys []string, hostname, fqdn string) (string, error) {
+	s := trimUserData(userdata)
+	header := userDataHeader(s)
+	switch {
+	case isMultipart(s):
+		return mergeMultipart(s, sshKeys, hostname, fqdn)
+	case strings.HasPrefix(s, "#!/"):
+		// assume it's a shell script, the cloud-config running it gets the SSH keys, hostname and fqdn
+		s = packageInCloudInit(s)
+	case s != "" && header != cloudConfigHeader:
+		contentType, ok := userDataContentTypes[header]
+		if !ok {
+			klog.Warningf("Unknown user data format, passing it unchanged without SSH keys and hostname")
+			return userdata, nil
+		}
+		return wrapInMultipart(s, contentType, sshKeys, hostname, fqdn)
 	}
-	return buf.String(), nil
+	return mergeCloudConfig(s, sshKeys, hostname, fqdn)
 }
 
-func prepareUserData(userdata string, sshKeys []string) (string, error) {
-	s := userdata
-	if strings.HasPrefix(userdata, "#!/") {
-		// assume it's a shell script and the ssh keys are appended directly to the authorized keys
-		s = packageInCloudInit(userdata)
-	}
-	return addSSHKeysSection(s, sshKeys)
+// trimUserData removes a byte order mark and leading white space, which cloud-init ignores
+func trimUserData(userdata string) string {
+	return strings.TrimLeftFunc(strings.TrimPrefix(userdata, "\ufeff"), unicode.IsSpace)
+}
+
+// userDataHeader returns the first line of the user data, which identifies the format
+func userDataHeader(userdata string) string {
+	return strings.TrimSpace(strings.SplitN(userdata, "\n", 2)[0])
 }
 
 func packageInCloudInit(userdata string) string {
@@ -88,17 +91,90 @@ runcmd:
 	return rewrittenUserdata
 }
 
-func addSSHKeysSection(userdata string, sshKeys []string) (string, error) {
-	if len(sshKeys) == 0 {
-		return userdata, nil
+// mergeCloudConfig parses the cloud-config and merges the SSH keys into `ssh_authorized_keys`, dropping duplicate keys.
+// `hostname` and `fqdn` are only set if not specified by the cloud-config. All other keys are preserved.
+func mergeCloudConfig(userdata string, sshKeys []string, hostname, fqdn string) (string, error) {
+	doc := &yaml.Node{Kind: yaml.DocumentNode}
+	if strings.TrimSpace(userdata) != "" {
+		if userDataHeader(userdata) != cloudConfigHeader {
+			return "", fmt.Errorf("unsupported user data format, expected cloud-config or shell script")
+		}
+		// the header is a comment, which is added again on serializing
+		body := ""
+		if lines := strings.SplitN(userdata, "\n", 2); len(lines) == 2 {
+			body = lines[1]
+		}
+		if err := yaml.Unmarshal([]byte(body), doc); err != nil {
+			return "", errors.Wrap(err, "parsing cloud-config failed")
+		}
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("cloud-config must be a mapping")
 	}
-	s := userdata
-	if strings.Contains(s, "ssh_authorized_keys:") {
-		return "", fmt.Errorf("userdata already contains key `ssh_authorized_keys`")
+	if hostname != "" && mappingValue(root, "hostname") == nil {
+		setMappingValue(root, "hostname", scalarNode(hostname))
+	}
+	if fqdn != "" && mappingValue(root, "fqdn") == nil {
+		setMappingValue(root, "fqdn", scalarNode(fqdn))
+	}
+
+	keys := mappingValue(root, "ssh_authorized_keys")
+	if keys == nil && len(sshKeys) > 0 {
+		keys = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(root, "ssh_authorized_keys", keys)
 	}
-	s = s + "\nssh_authorized_keys:\n"
-	for _, key := range sshKeys {
-		s = s + fmt.Sprintf("- %q\n", key)
+	if keys != nil && (keys.Kind == yaml.SequenceNode || len(sshKeys) > 0) {
+		if keys.Kind != yaml.SequenceNode {
+			return "", fmt.Errorf("`ssh_authorized_keys` of cloud-config must be a list")
+		}
+		existing := map[string]bool{}
+		var content []*yaml.Node
+		for _, key := range keys.Content {
+			if value := strings.TrimSpace(key.Value); !existing[value] {
+				existing[value] = true
+				content = append(content, key)
+			}
+		}
+		for _, key := range sshKeys {
+			if !existing[key] {
+				existing[key] = true
+				content = append(content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Style: yaml.DoubleQuotedStyle})
+			}
+		}
+		keys.Content = content
 	}
-	return s, nil
+
+	var buf bytes.Buffer
+	buf.WriteString(cloudConfigHeader + "\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return "", errors.Wrap(err, "serializing cloud-config failed")
+	}
+	if err := encoder.Close(); err != nil {
+		return "", errors.Wrap(err, "serializing cloud-config failed")
+	}
+	return buf.String(), nil
+}
+
+// mappingValue returns the value node of the key or nil
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	mapping.Content = append(mapping.Content, scalarNode(key), value)
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
 }
@@ -19,8 +19,17 @@
 package internal
 
 import (
-	"github.com/onsi/gomega"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
 	"testing"
+
+	"github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
 )
 
 const expectedContent = `{
@@ -31,7 +40,7 @@ const expectedContent = `{
 	"directories":[{"filesystem":"root","path":"/var/lib/coreos-install","mode":493}],
 	"files":[
 	  {"filesystem":"root","path":"/etc/hostname","contents":{"source":"data:,foo"},"mode":420},
-	  {"filesystem":"root","path":"/var/lib/coreos-install/user_data","contents":{"source":"data:text/plain;charset=utf-8;base64,XYZ"},"mode":420}
+	  {"filesystem":"root","path":"/var/lib/coreos-install/user_data","contents":{"source":"data:text/plain;charset=utf-8;base64,I2Nsb3VkLWNvbmZpZwo="},"mode":420}
 	]
   },
   "systemd":{}
@@ -42,37 +51,230 @@ func TestCoreOSIgnition(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 
 	config := &ignitionConfig{
-		PasswdHash:     "$1$9H6.uffe$e5XfhfWO4EcT8JdUvzEOT0",
-		Hostname:       "foo",
-		SSHKeys:        []string{"ssh1", "ssh2"},
-		UserdataBase64: "XYZ",
-		InstallPath:    "/var/lib/coreos-install",
+		PasswdHash:  "$1$9H6.uffe$e5XfhfWO4EcT8JdUvzEOT0",
+		Hostname:    "foo",
+		SSHKeys:     []string{"ssh1", "ssh2"},
+		Userdata:    "#cloud-config\n",
+		InstallPath: "/var/lib/coreos-install",
 	}
 	content, err := ignitionFile(config)
 	if err != nil {
 		t.Errorf("coreosIgnition failed with %s", err)
 	}
 
-	g.Expect(content).To(gomega.Equal(expectedContent))
+	g.Expect(content).To(gomega.MatchJSON(expectedContent))
+}
+
+const expectedContentV3 = `{
+  "ignition": {"config":{"merge":[{"source":"data:text/plain;charset=utf-8;base64,eyJpZ25pdGlvbiI6eyJ2ZXJzaW9uIjoiMy4zLjAifX0="}]},"version":"3.3.0"},
+  "passwd":{"users":[{"name":"core","passwordHash":"*","sshAuthorizedKeys":["ssh \"quoted\""]}]},
+  "storage": {
+	"files":[
+	  {"path":"/etc/hostname","contents":{"source":"data:,foo"},"mode":420,"overwrite":true},
+	  {"path":"/etc/systemd/network/00-ens192.network","contents":{"source":"data:,%5BMatch%5D%0AName=ens192%0A%0A%5BNetwork%5D%0ADHCP=yes%0ALinkLocalAddressing=no%0AIPv6AcceptRA=no%0A"},"mode":420,"overwrite":true}
+	]
+  }
+}
+`
+
+func TestIgnitionV3MergesUserdata(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	config := &ignitionConfig{
+		PasswdHash:  "*",
+		Hostname:    "foo",
+		SSHKeys:     []string{`ssh "quoted"`},
+		Userdata:    `{"ignition":{"version":"3.3.0"}}`,
+		InstallPath: "/var/lib/flatcar-install",
+	}
+	content, err := ignitionFile(config)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(content).To(gomega.MatchJSON(expectedContentV3))
+
+	config.Version = "2.3.0"
+	_, err = ignitionFile(config)
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	config.Version = "4.0.0"
+	_, err = ignitionFile(config)
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestIgnitionCompressesUserdata(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	userdata := "#cloud-config\n" + strings.Repeat("runcmd:\n- echo hello\n", 1000)
+	for _, version := range []string{"2.3.0", "3.3.0"} {
+		content, err := ignitionFile(&ignitionConfig{Version: version, Hostname: "foo", Userdata: userdata, InstallPath: "/var/lib/flatcar-install"})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(len(content) < len(userdata)).To(gomega.BeTrue(), version)
+
+		var ign struct {
+			Storage struct {
+				Files []struct {
+					Path     string               `json:"path"`
+					Contents ignitionFileContents `json:"contents"`
+				} `json:"files"`
+			} `json:"storage"`
+		}
+		g.Expect(json.Unmarshal([]byte(content), &ign)).To(gomega.Succeed())
+		file := ign.Storage.Files[len(ign.Storage.Files)-1]
+		g.Expect(file.Path).To(gomega.Equal("/var/lib/flatcar-install/user_data"))
+		g.Expect(file.Contents.Compression).To(gomega.Equal("gzip"))
+		g.Expect(gunzipBase64(t, strings.TrimPrefix(file.Contents.Source, "data:;base64,"))).To(gomega.Equal(userdata))
+	}
 }
 
-func TestAddSSHKeys(t *testing.T) {
+func TestMergeCloudConfig(t *testing.T) {
 	g := gomega.NewGomegaWithT(t)
 	userdata := `#cloud-config
 runcmd:
 - 'echo 127.0.0.1 $(hostname) >> /etc/hosts-xxx'
+write_files:
+- path: /etc/foo
+  content: |
+    bar
+ssh_authorized_keys:
+- ssh1
+- ssh1
 `
 
-	newUserdata, err := addSSHKeysSection(userdata, []string{"ssh1", "ssh2"})
+	newUserdata, err := mergeCloudConfig(userdata, []string{"ssh1", "ssh2"}, "foo", "foo.example.com")
 	if err != nil {
-		t.Errorf("addSSHKeysSection failed with %s", err)
+		t.Errorf("mergeCloudConfig failed with %s", err)
 	}
 	g.Expect(newUserdata).To(gomega.Equal(`#cloud-config
 runcmd:
-- 'echo 127.0.0.1 $(hostname) >> /etc/hosts-xxx'
-
+  - 'echo 127.0.0.1 $(hostname) >> /etc/hosts-xxx'
+write_files:
+  - path: /etc/foo
+    content: |
+      bar
 ssh_authorized_keys:
-- "ssh1"
-- "ssh2"
+  - ssh1
+  - "ssh2"
+hostname: foo
+fqdn: foo.example.com
 `))
+
+	newUserdata, err = mergeCloudConfig("#cloud-config\nhostname: bar\n", []string{"ssh1"}, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(newUserdata).To(gomega.Equal("#cloud-config\nhostname: bar\nssh_authorized_keys:\n  - \"ssh1\"\n"))
+
+	newUserdata, err = mergeCloudConfig("", nil, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(newUserdata).To(gomega.Equal("#cloud-config\nhostname: foo\n"))
+
+	_, err = mergeCloudConfig("#cloud-config\nssh_authorized_keys: ssh1\n", []string{"ssh2"}, "foo", "")
+	g.Expect(err).To(gomega.HaveOccurred())
+	_, err = mergeCloudConfig("#include https://example.com\n", nil, "foo", "")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestPrepareShellScriptUserData(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	script := "#!/bin/bash\necho hello\n"
+
+	newUserdata, err := prepareUserData(script, []string{"ssh1"}, "foo", "foo.example.com")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(newUserdata).To(gomega.HavePrefix(cloudConfigHeader + "\n"))
+
+	var cloudConfig struct {
+		WriteFiles []struct {
+			Content string `yaml:"content"`
+		} `yaml:"write_files"`
+		Hostname          string   `yaml:"hostname"`
+		FQDN              string   `yaml:"fqdn"`
+		SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+	}
+	g.Expect(yaml.Unmarshal([]byte(newUserdata), &cloudConfig)).To(gomega.Succeed())
+	g.Expect(cloudConfig.Hostname).To(gomega.Equal("foo"))
+	g.Expect(cloudConfig.FQDN).To(gomega.Equal("foo.example.com"))
+	g.Expect(cloudConfig.SSHAuthorizedKeys).To(gomega.Equal([]string{"ssh1"}))
+	g.Expect(cloudConfig.WriteFiles).To(gomega.HaveLen(1))
+	g.Expect(cloudConfig.WriteFiles[0].Content).To(gomega.Equal(base64.StdEncoding.EncodeToString([]byte(script))))
+}
+
+func TestPrepareMultipartUserData(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	userdata := "Content-Type: multipart/mixed; boundary=\"XXX\"\nMIME-Version: 1.0\n\n" +
+		"--XXX\nContent-Type: text/x-shellscript\nContent-Transfer-Encoding: base64\n\nZWNobyBoZWxsbwo=\n" +
+		"--XXX\nContent-Type: text/cloud-config\n\n#cloud-config\nruncmd:\n- echo\n" +
+		"--XXX--\n"
+
+	newUserdata, err := prepareUserData(userdata, []string{"ssh1"}, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	parts := readMultipart(t, newUserdata)
+	g.Expect(parts).To(gomega.HaveLen(3))
+	g.Expect(parts[0].header.Get("Content-Type")).To(gomega.Equal("text/x-shellscript"))
+	g.Expect(parts[0].header.Get("Content-Transfer-Encoding")).To(gomega.Equal("base64"))
+	g.Expect(string(parts[0].content)).To(gomega.Equal("ZWNobyBoZWxsbwo="))
+	g.Expect(string(parts[1].content)).To(gomega.Equal("#cloud-config\nruncmd:\n- echo"))
+	g.Expect(parts[2].header.Get("Content-Type")).To(gomega.Equal("text/cloud-config; charset=utf-8"))
+	g.Expect(parts[2].header.Get("Merge-Type")).To(gomega.Equal(cloudConfigMergeType))
+	g.Expect(string(parts[2].content)).To(gomega.Equal("#cloud-config\nhostname: foo\nssh_authorized_keys:\n  - \"ssh1\"\n"))
+
+	newUserdata, err = prepareUserData("#cloud-boothook\necho hello\n", nil, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	parts = readMultipart(t, newUserdata)
+	g.Expect(parts).To(gomega.HaveLen(2))
+	g.Expect(parts[0].header.Get("Content-Type")).To(gomega.Equal("text/cloud-boothook; charset=utf-8"))
+	g.Expect(string(parts[0].content)).To(gomega.Equal("#cloud-boothook\necho hello\n"))
+
+	archive := "#cloud-config-archive\n- type: text/cloud-config\n  content: |\n    runcmd:\n    - echo\n"
+	newUserdata, err = prepareUserData(archive, []string{"ssh1"}, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	parts = readMultipart(t, newUserdata)
+	g.Expect(parts).To(gomega.HaveLen(2))
+	g.Expect(parts[0].header.Get("Content-Type")).To(gomega.Equal("text/cloud-config-archive; charset=utf-8"))
+	g.Expect(string(parts[0].content)).To(gomega.Equal(archive))
+
+	jinja := "## template: jinja\n#cloud-config\nruncmd:\n- echo {{ v1.local_hostname }}\n"
+	newUserdata, err = prepareUserData(jinja, nil, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	parts = readMultipart(t, newUserdata)
+	g.Expect(parts).To(gomega.HaveLen(2))
+	g.Expect(parts[0].header.Get("Content-Type")).To(gomega.Equal("text/jinja2; charset=utf-8"))
+	g.Expect(string(parts[0].content)).To(gomega.Equal(jinja))
+}
+
+func TestPrepareUserDataFormats(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// leading white space and byte order mark are ignored
+	newUserdata, err := prepareUserData("\ufeff\n#cloud-config\nruncmd:\n- echo\n", []string{"ssh1"}, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(newUserdata).To(gomega.Equal("#cloud-config\nruncmd:\n  - echo\nhostname: foo\nssh_authorized_keys:\n  - \"ssh1\"\n"))
+
+	// unknown formats are passed unchanged
+	newUserdata, err = prepareUserData("foo=bar\n", []string{"ssh1"}, "foo", "")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(newUserdata).To(gomega.Equal("foo=bar\n"))
+}
+
+func readMultipart(t *testing.T, userdata string) []userDataPart {
+	msg, err := mail.ReadMessage(strings.NewReader(userdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []userDataPart
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, userDataPart{header: part.Header, content: content})
+	}
 }
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+const tagCategoryDescription = "created by machine-controller-manager-provider-vsphere"
+
+// tagManager is the part of the vSphere tags manager needed to create categories and tags
+type tagManager interface {
+	GetCategories(ctx context.Context) ([]tags.Category, error)
+	CreateCategory(ctx context.Context, category *tags.Category) (string, error)
+	GetTagsForCategory(ctx context.Context, id string) ([]tags.Tag, error)
+	CreateTag(ctx context.Context, tag *tags.Tag) (string, error)
+}
+
+// usesCustomAttributes checks if the tags of the spec are placed as custom attributes
+func usesCustomAttributes(spec *api.VsphereProviderSpec) bool {
+	return spec.TagMode != api.TagModeVSphereTags
+}
+
+// usesVSphereTags checks if the tags of the spec are placed as vSphere tags
+func usesVSphereTags(spec *api.VsphereProviderSpec) bool {
+	return spec.TagMode == api.TagModeVSphereTags || spec.TagMode == api.TagModeBoth
+}
+
+// attachVSphereTags attaches the tags as vSphere tags to the object.
+// The tag key is used as category and the value as tag name. Missing categories and tags are created.
+func attachVSphereTags(ctx context.Context, restClient *rest.Client, ref mo.Reference, tagMap map[string]string) error {
+	manager := tags.NewManager(restClient)
+
+	var tagIDs []string
+	for category, name := range tagMap {
+		categoryID, err := ensureTagCategory(ctx, manager, category)
+		if err != nil {
+			return err
+		}
+		tagID, err := ensureTag(ctx, manager, categoryID, category, name)
+		if err != nil {
+			return err
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+
+	if err := manager.AttachMultipleTagsToObject(ctx, tagIDs, ref); err != nil {
+		return errors.Wrap(err, "attaching vSphere tags failed")
+	}
+	return nil
+}
+
+func ensureTagCategory(ctx context.Context, manager tagManager, name string) (string, error) {
+	category, err := findTagCategory(ctx, manager, name)
+	if err != nil {
+		return "", err
+	}
+	if category != nil {
+		return category.ID, nil
+	}
+
+	id, err := manager.CreateCategory(ctx, &tags.Category{
+		Name:            name,
+		Description:     tagCategoryDescription,
+		Cardinality:     "SINGLE",
+		AssociableTypes: []string{"VirtualMachine"},
+	})
+	if err != nil {
+		// the category may have been created concurrently by another machine
+		if category, err2 := findTagCategory(ctx, manager, name); err2 == nil && category != nil {
+			return category.ID, nil
+		}
+		return "", errors.Wrapf(err, "creating tag category %q failed", name)
+	}
+	return id, nil
+}
+
+func findTagCategory(ctx context.Context, manager tagManager, name string) (*tags.Category, error) {
+	categories, err := manager.GetCategories(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tag categories failed")
+	}
+	for i := range categories {
+		if categories[i].Name == name {
+			return &categories[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func ensureTag(ctx context.Context, manager tagManager, categoryID, category, name string) (string, error) {
+	tag, err := findTag(ctx, manager, categoryID, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "listing tags of category %q failed", category)
+	}
+	if tag != nil {
+		return tag.ID, nil
+	}
+
+	id, err := manager.CreateTag(ctx, &tags.Tag{
+		Name:       name,
+		CategoryID: categoryID,
+	})
+	if err != nil {
+		// the tag may have been created concurrently by another machine
+		if tag, err2 := findTag(ctx, manager, categoryID, name); err2 == nil && tag != nil {
+			return tag.ID, nil
+		}
+		return "", errors.Wrapf(err, "creating tag %q in category %q failed", name, category)
+	}
+	return id, nil
+}
+
+func findTag(ctx context.Context, manager tagManager, categoryID, name string) (*tags.Tag, error) {
+	list, err := manager.GetTagsForCategory(ctx, categoryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Name == name {
+			return &list[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// vsphereTagsOnObjects returns the attached vSphere tags of the objects as map of category name to tag name
+func vsphereTagsOnObjects(ctx context.Context, restClient *rest.Client, refs []mo.Reference) (map[types.ManagedObjectReference]map[string]string, error) {
+	result := map[types.ManagedObjectReference]map[string]string{}
+	if len(refs) == 0 {
+		return result, nil
+	}
+
+	manager := tags.NewManager(restClient)
+	categories, err := manager.GetCategories(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tag categories failed")
+	}
+	categoryNames := map[string]string{}
+	for _, category := range categories {
+		categoryNames[category.ID] = category.Name
+	}
+
+	attached, err := manager.GetAttachedTagsOnObjects(ctx, refs)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing attached tags failed")
+	}
+	for _, item := range attached {
+		tagMap := map[string]string{}
+		for _, tag := range item.Tags {
+			if category, ok := categoryNames[tag.CategoryID]; ok {
+				tagMap[category] = tag.Name
+			}
+		}
+		result[item.ObjectID.Reference()] = tagMap
+	}
+	return result, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2023 SAP SE or an SAP affiliate company. All rights reserved. This file is licensed under the Apache Software License, v. 2 except as noted otherwise in the LICENSE file
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ *
+ */
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/vmware/govmomi/vapi/tags"
+
+	api "github.com/gardener/machine-controller-manager-provider-vsphere/pkg/vsphere/apis"
+)
+
+// fakeTagManager keeps categories and tags in memory. With concurrent set, creating fails after
+// adding the object, like a concurrent creation by another machine.
+type fakeTagManager struct {
+	categories []tags.Category
+	tags       []tags.Tag
+	concurrent bool
+}
+
+func (m *fakeTagManager) GetCategories(_ context.Context) ([]tags.Category, error) {
+	return m.categories, nil
+}
+
+func (m *fakeTagManager) CreateCategory(_ context.Context, category *tags.Category) (string, error) {
+	c := *category
+	c.ID = fmt.Sprintf("category-%d", len(m.categories)+1)
+	m.categories = append(m.categories, c)
+	if m.concurrent {
+		return "", fmt.Errorf("already exists")
+	}
+	return c.ID, nil
+}
+
+func (m *fakeTagManager) GetTagsForCategory(_ context.Context, id string) ([]tags.Tag, error) {
+	var result []tags.Tag
+	for _, tag := range m.tags {
+		if tag.CategoryID == id {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+func (m *fakeTagManager) CreateTag(_ context.Context, tag *tags.Tag) (string, error) {
+	t := *tag
+	t.ID = fmt.Sprintf("tag-%d", len(m.tags)+1)
+	m.tags = append(m.tags, t)
+	if m.concurrent {
+		return "", fmt.Errorf("already exists")
+	}
+	return t.ID, nil
+}
+
+func TestTagMode(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	for mode, expected := range map[string][2]bool{
+		"":                          {true, false},
+		api.TagModeCustomAttributes: {true, false},
+		api.TagModeVSphereTags:      {false, true},
+		api.TagModeBoth:             {true, true},
+	} {
+		spec := &api.VsphereProviderSpec{TagMode: mode}
+		g.Expect(usesCustomAttributes(spec)).To(gomega.Equal(expected[0]), mode)
+		g.Expect(usesVSphereTags(spec)).To(gomega.Equal(expected[1]), mode)
+	}
+}
+
+func TestEnsureTagCategoryAndTag(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.TODO()
+
+	manager := &fakeTagManager{}
+	categoryID, err := ensureTagCategory(ctx, manager, "mcm.gardener.cloud/role")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(categoryID).To(gomega.Equal("category-1"))
+	g.Expect(manager.categories[0].Cardinality).To(gomega.Equal("SINGLE"))
+	g.Expect(manager.categories[0].AssociableTypes).To(gomega.Equal([]string{"VirtualMachine"}))
+
+	// existing categories and tags are reused
+	categoryID, err = ensureTagCategory(ctx, manager, "mcm.gardener.cloud/role")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(categoryID).To(gomega.Equal("category-1"))
+	g.Expect(manager.categories).To(gomega.HaveLen(1))
+
+	tagID, err := ensureTag(ctx, manager, categoryID, "mcm.gardener.cloud/role", "node")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(tagID).To(gomega.Equal("tag-1"))
+	tagID, err = ensureTag(ctx, manager, categoryID, "mcm.gardener.cloud/role", "node")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(tagID).To(gomega.Equal("tag-1"))
+	g.Expect(manager.tags).To(gomega.HaveLen(1))
+
+	// created concurrently by another machine
+	manager.concurrent = true
+	categoryID, err = ensureTagCategory(ctx, manager, "mcm.gardener.cloud/cluster")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(categoryID).To(gomega.Equal("category-2"))
+	tagID, err = ensureTag(ctx, manager, categoryID, "mcm.gardener.cloud/cluster", "shoot--foo--bar")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(tagID).To(gomega.Equal("tag-2"))
+}
@@ -65,6 +65,9 @@ func prepareErrorf(err error, format string, args ...interface{}) error {
 		wrapped = err
 	default:
 		code = codes.Internal
+		if _, ok := errors.Cause(err).(*errors2.InvalidArgumentError); ok {
+			code = codes.InvalidArgument
+		}
 		wrapped = errors.Wrap(err, fmt.Sprintf(format, args...))
 	}
 	klog.V(2).Infof(wrapped.Error())